@@ -0,0 +1,63 @@
+package goclear
+
+import "fmt"
+import "reflect"
+import "sort"
+
+// Slices record the address of their first element in "data".
+// After a dump, slices whose backing arrays overlap (up to their capacity,
+// since an append may write there) are flagged:
+//	aliased: true,
+//	backing: "data of the lowest slice of the group",
+//	offset: index of the slice's first element, counted from backing
+// Compare sets "reallocated" on a slice whose data moved since the last dump
+
+// A slice seen during a dump, kept for the aliasing analysis
+type sliceNode struct {
+	vardict  VarDict
+	data     uintptr
+	cap      int
+	elemSize uintptr
+}
+
+func (node sliceNode) end() uintptr {
+	return node.data + uintptr(node.cap)*node.elemSize
+}
+
+func (w *walker) recordSlice(vardict VarDict, v reflect.Value) {
+	data := v.Pointer()
+	vardict.SetField("data", fmt.Sprintf("%d", data))
+	vardict.SetField("offset", 0)
+	elemSize := v.Type().Elem().Size()
+	if data == 0 || v.Cap() == 0 || elemSize == 0 {
+		return
+	}
+	w.slices = append(w.slices, sliceNode{vardict, data, v.Cap(), elemSize})
+}
+
+// Flag the slices sharing a backing array, with their offsets in it
+func (w *walker) analyzeAliases() {
+	sort.Slice(w.slices, func(i, j int) bool {
+		return w.slices[i].data < w.slices[j].data
+	})
+	for start := 0; start < len(w.slices); {
+		// Grow the group while the next slice starts within the group's memory
+		end := start + 1
+		limit := w.slices[start].end()
+		for end < len(w.slices) && w.slices[end].data < limit {
+			if w.slices[end].end() > limit {
+				limit = w.slices[end].end()
+			}
+			end++
+		}
+		if end-start > 1 {
+			base := w.slices[start]
+			for _, node := range w.slices[start:end] {
+				node.vardict.SetField("aliased", true)
+				node.vardict.SetField("backing", fmt.Sprintf("%d", base.data))
+				node.vardict.SetField("offset", int((node.data-base.data)/node.elemSize))
+			}
+		}
+		start = end
+	}
+}
@@ -0,0 +1,40 @@
+package goclear
+
+import "testing"
+
+func TestAliasedSlices(t *testing.T) {
+	type Buffers struct {
+		A, B, C []int
+	}
+	base := make([]int, 3, 10)
+	a := base[:2]
+	b := append(base[:3], 4) // shares a's backing array
+	c := []int{7, 8}
+	vd := GetVarDict("bufs", Buffers{a, b[2:], c})
+	fields := vd["value"].(map[string]interface{})
+	va, vb, vc := fields["A"].(VarDict), fields["B"].(VarDict), fields["C"].(VarDict)
+	if va["aliased"] != true || vb["aliased"] != true {
+		t.Fatalf("A and B share a backing array: %v %v", va, vb)
+	}
+	if va["backing"] != vb["backing"] || va["offset"] != 0 || vb["offset"] != 2 {
+		t.Errorf("unexpected backing/offset: %v/%v %v/%v", va["backing"], va["offset"], vb["backing"], vb["offset"])
+	}
+	if vc["aliased"] != nil {
+		t.Errorf("C has its own backing array: %v", vc)
+	}
+}
+
+func TestCompareReallocatedSlice(t *testing.T) {
+	s := make([]int, 2, 2)
+	vd1 := GetVarDict("s", s)
+	s[0] = 1
+	vd2 := GetVarDict("s", s)
+	if vd2.Compare(vd1) || vd2["reallocated"] != nil {
+		t.Errorf("a slice modified in place is not reallocated: %v", vd2)
+	}
+	s = append(s, 3)
+	vd3 := GetVarDict("s", s)
+	if vd3.Compare(vd2) || vd3["reallocated"] != true {
+		t.Errorf("appending beyond capacity reallocates: %v", vd3)
+	}
+}
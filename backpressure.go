@@ -0,0 +1,337 @@
+package goclear
+
+import "encoding/json"
+import "fmt"
+import "io"
+import "os"
+import "path/filepath"
+import "strconv"
+import "strings"
+import "sync"
+
+// A Backpressure policy tells PostRecord what to do when the queue of the workers is full
+type Backpressure string
+
+const (
+	// Wait for room in the queue, stalling the caller while the sink is slow
+	BackpressureBlock Backpressure = "block"
+	// Drop the record being posted
+	BackpressureDropNewest Backpressure = "drop-newest"
+	// Drop the oldest record of the queue to make room, keeping the most recent values
+	BackpressureDropOldest Backpressure = "drop-oldest"
+	// Append the record to a file in SpillDir, fed back to the workers as the queue empties
+	BackpressureSpill Backpressure = "spill"
+)
+
+// A record in the queue of the workers
+type queuedRecord struct {
+	record Record
+	// Values of the same variable dropped before this one
+	gap int64
+	// Whether the record is a diff against the last value of its variable
+	based bool
+}
+
+// Count the records dropped for each variable name.
+// A dropped value is also forgotten as the last value of its variable,
+// so that the next one is recorded in full, and carries the number of values lost before it
+type dropCounter struct {
+	mu    sync.Mutex
+	total map[string]int64
+	gaps  map[string]int64
+	// When drop-oldest evicts a queued record, the diffs of its variable queued behind it
+	// have a base that is never stored: they are dropped too, up to the next full record.
+	// The sequence number of the evicted record, by variable name
+	cuts map[string]int64
+}
+
+func newDropCounter() *dropCounter {
+	return &dropCounter{total: make(map[string]int64), gaps: make(map[string]int64), cuts: make(map[string]int64)}
+}
+
+// Cut the chain of diffs of a variable after an evicted record
+func (drops *dropCounter) cut(evicted Record) {
+	drops.mu.Lock()
+	defer drops.mu.Unlock()
+	drops.cuts[evicted.Name] = evicted.Sequence
+}
+
+// Tell whether a record taken from the queue is a diff in a chain that was cut.
+// The workers take the records in order: a full record ends the cut
+func (drops *dropCounter) isCut(item queuedRecord) bool {
+	drops.mu.Lock()
+	defer drops.mu.Unlock()
+	after, ok := drops.cuts[item.record.Name]
+	if !ok || item.record.Sequence <= after {
+		return false
+	}
+	if !item.based {
+		delete(drops.cuts, item.record.Name)
+		return false
+	}
+	return true
+}
+
+// The name the records lost with their name are counted under
+const lostName = ""
+
+// Count a dropped record, and the gap it carried
+func (drops *dropCounter) add(name string, gap int64) {
+	drops.mu.Lock()
+	defer drops.mu.Unlock()
+	drops.total[name]++
+	drops.gaps[name] += gap + 1
+}
+
+// Take the number of values of a variable dropped since the last one queued
+func (drops *dropCounter) takeGap(name string) int64 {
+	drops.mu.Lock()
+	defer drops.mu.Unlock()
+	gap := drops.gaps[name]
+	delete(drops.gaps, name)
+	return gap
+}
+
+func (drops *dropCounter) counts() map[string]int64 {
+	drops.mu.Lock()
+	defer drops.mu.Unlock()
+	if len(drops.total) == 0 {
+		return nil
+	}
+	counts := make(map[string]int64, len(drops.total))
+	for name, n := range drops.total {
+		counts[name] = n
+	}
+	return counts
+}
+
+// A spill file keeps the records that found the queue full, in order.
+// Once a record is spilled, the following ones are spilled too until the file is drained,
+// so that the workers still see the records in the order they were posted.
+// A spill file only extends the queue of its process: it is never replayed by another one.
+// The files left by processes no longer running are removed when a spill is created,
+// their records are lost like those of a queue in memory
+type spill struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	file *os.File
+	// Frames are written at writeOffset and read back from readOffset
+	writeOffset int64
+	readOffset  int64
+	// Records spilled and not yet handed to a worker
+	queued int
+	closed bool
+	// The sequence number of the last record read back
+	lastSequence int64
+}
+
+// A frame of a spill file: the record with its place in the queue
+type spilledRecord struct {
+	Record Record `json:"record"`
+	Gap    int64  `json:"gap,omitempty"`
+	Based  bool   `json:"based,omitempty"`
+}
+
+func newSpill(dir string, session *Session) (*spill, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	removeLeftoverSpills(dir)
+	name := fmt.Sprintf("spill-%d-%d-%d.log", os.Getpid(), session.ID, session.Timestamp)
+	file, err := os.OpenFile(filepath.Join(dir, name), os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	s := &spill{file: file}
+	s.cond = sync.NewCond(&s.mu)
+	return s, nil
+}
+
+// Remove the spill files of processes no longer running
+func removeLeftoverSpills(dir string) {
+	paths, _ := filepath.Glob(filepath.Join(dir, "spill-*.log"))
+	for _, path := range paths {
+		fields := strings.SplitN(strings.TrimPrefix(filepath.Base(path), "spill-"), "-", 2)
+		pid, err := strconv.Atoi(fields[0])
+		if err != nil || processAlive(pid) {
+			continue
+		}
+		logWarn("Removing the spill file of an earlier run, its records are lost", "path", path)
+		os.Remove(path)
+	}
+}
+
+// Append a record to the file, the caller holding the lock
+func (s *spill) push(item queuedRecord) error {
+	payload, err := json.Marshal(spilledRecord{item.record, item.gap, item.based})
+	if err != nil {
+		return err
+	}
+	frame := appendFrame(nil, payload)
+	if _, err := s.file.WriteAt(frame, s.writeOffset); err != nil {
+		return err
+	}
+	s.writeOffset += int64(len(frame))
+	s.queued++
+	s.cond.Signal()
+	return nil
+}
+
+// Wait for the next spilled record; false once the spill is closed and drained.
+// The records that can not be read back are skipped, and counted in lost
+// with the sequence number of the last record read before them
+func (s *spill) next(lost func(records int, after int64, err error)) (queuedRecord, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		for s.readOffset == s.writeOffset && !s.closed {
+			s.cond.Wait()
+		}
+		if s.readOffset == s.writeOffset {
+			return queuedRecord{}, false
+		}
+		section := io.NewSectionReader(s.file, s.readOffset, s.writeOffset-s.readOffset)
+		payload, err := readFrame(section)
+		if err != nil {
+			// The rest of the file can not be framed any more, its records are lost
+			logError("Fail to read spilled records", "records", s.queued, "error", err)
+			lost(s.queued, s.lastSequence, err)
+			s.readOffset, s.queued = s.writeOffset, 0
+			s.reuse()
+			continue
+		}
+		s.readOffset += int64(frameHeaderSize + len(payload))
+		var frame spilledRecord
+		if err := json.Unmarshal(payload, &frame); err != nil {
+			logError("Fail to read spilled record", "error", err)
+			s.queued--
+			lost(1, s.lastSequence, err)
+			s.reuse()
+			continue
+		}
+		s.lastSequence = frame.Record.Sequence
+		return queuedRecord{record: frame.Record, gap: frame.Gap, based: frame.Based}, true
+	}
+}
+
+// Mark the record returned by next as handed to a worker, and reuse the file once drained
+func (s *spill) done() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queued--
+	s.reuse()
+}
+
+// Start the file over once drained, the caller holding the lock
+func (s *spill) reuse() {
+	if s.queued == 0 && s.readOffset == s.writeOffset {
+		s.file.Truncate(0)
+		s.readOffset, s.writeOffset = 0, 0
+	}
+}
+
+// Stop accepting records; next returns false once the file is drained
+func (s *spill) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	s.cond.Broadcast()
+}
+
+// Remove the file, once drained
+func (s *spill) remove() error {
+	s.file.Close()
+	return os.Remove(s.file.Name())
+}
+
+// Feed the spilled records to the workers, until the spill is closed and drained
+func (r *Recorder) feedSpill() {
+	defer r.spillDone.Done()
+	for {
+		item, ok := r.spill.next(r.lostSpilled)
+		if !ok {
+			return
+		}
+		r.records <- item
+		r.spill.done()
+	}
+}
+
+// Count spilled records that could not be read back. Their variables are unknown:
+// every variable is recorded in full from its next value, and the diffs queued
+// after the last record read are dropped, as they may be based on a lost one
+func (r *Recorder) lostSpilled(records int, after int64, err error) {
+	for _, name := range r.last.forgetAll() {
+		r.drops.cut(Record{Name: name, Sequence: after})
+	}
+	for i := 0; i < records; i++ {
+		r.drops.add(lostName, 0)
+	}
+	r.pending.add(-records)
+	r.reportError(&RecordError{Kind: ErrQueueFull, Records: records, Lost: true, Cause: err})
+}
+
+// Queue a record following the backpressure policy.
+// Return an error if the record is dropped; the records of other calls dropped
+// to make room are reported to OnError
+func (r *Recorder) enqueue(item queuedRecord) error {
+	switch r.config.Backpressure {
+	case BackpressureBlock:
+		r.records <- item
+	case BackpressureDropOldest:
+		for {
+			select {
+			case r.records <- item:
+				return nil
+			default:
+			}
+			select {
+			case old := <-r.records:
+				r.dropped(old)
+				r.drops.cut(old.record)
+				r.reportError(&RecordError{Kind: ErrQueueFull, Name: old.record.Name, Records: 1, Lost: true})
+			default:
+			}
+		}
+	case BackpressureSpill:
+		r.spill.mu.Lock()
+		defer r.spill.mu.Unlock()
+		if r.spill.queued == 0 {
+			select {
+			case r.records <- item:
+				return nil
+			default:
+			}
+		}
+		if err := r.spill.push(item); err != nil {
+			logError("Fail to spill record", "name", item.record.Name, "error", err)
+			r.dropped(item)
+			return &RecordError{Kind: ErrQueueFull, Name: item.record.Name, Records: 1, Lost: true, Cause: err}
+		}
+	default:
+		select {
+		case r.records <- item:
+		default:
+			r.dropped(item)
+			return &RecordError{Kind: ErrQueueFull, Name: item.record.Name, Records: 1, Lost: true}
+		}
+	}
+	return nil
+}
+
+// Drop a record taken from the queue whose chain of diffs was cut; tell whether it was
+func (r *Recorder) dropCut(item queuedRecord) bool {
+	if !r.drops.isCut(item) {
+		return false
+	}
+	r.dropped(item)
+	r.reportError(&RecordError{Kind: ErrQueueFull, Name: item.record.Name, Records: 1, Lost: true})
+	return true
+}
+
+func (r *Recorder) dropped(item queuedRecord) {
+	logDebug("Dropped record", "name", item.record.Name)
+	r.drops.add(item.record.Name, item.gap)
+	r.last.forget(item.record.Name)
+	r.pending.add(-1)
+}
@@ -0,0 +1,226 @@
+package goclear
+
+import "context"
+import "fmt"
+import "os"
+import "path/filepath"
+import "testing"
+
+// A sink whose writes wait until the gate is opened, telling when a worker is stuck in it
+type gatedSink struct {
+	*MemorySink
+	gate    chan struct{}
+	entered chan struct{}
+}
+
+func (sink *gatedSink) WriteBatch(records []Record) error {
+	select {
+	case sink.entered <- struct{}{}:
+	default:
+	}
+	<-sink.gate
+	return sink.MemorySink.WriteBatch(records)
+}
+
+// Dump x=0..9 while the only worker is stuck with x=0 and the queue holds 2 records
+func dumpWithStuckWorker(t *testing.T, policy Backpressure) (*Recorder, *gatedSink) {
+	sink := &gatedSink{MemorySink: NewMemorySink(), gate: make(chan struct{}), entered: make(chan struct{}, 1)}
+	r, err := NewRecorder(Configuration{MaxDepth: 5, Sink: sink, SpoolDir: t.TempDir(), QueueSize: 2, BatchSize: 1,
+		Backpressure: policy, SpillDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.DumpVar("x", 0)
+	<-sink.entered
+	for i := 1; i < 10; i++ {
+		r.DumpVar("x", i)
+	}
+	close(sink.gate)
+	r.Flush(context.Background())
+	return r, sink
+}
+
+func recordedValues(t *testing.T, sink Source, sessionID int64) []string {
+	records, _ := sink.Records(sessionID, 0, 100)
+	values := make([]string, 0)
+	for _, record := range records {
+		vardict, err := ParseVarDict(record.Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		values = append(values, fmt.Sprint(vardict["value"]))
+	}
+	return values
+}
+
+func TestDropNewest(t *testing.T) {
+	r, sink := dumpWithStuckWorker(t, BackpressureDropNewest)
+	if fmt.Sprint(recordedValues(t, sink, r.SessionID())) != "[0 1 2]" {
+		t.Errorf("expected the first values to be kept: %v", recordedValues(t, sink, r.SessionID()))
+	}
+	if r.Dropped()["x"] != 7 {
+		t.Errorf("expected 7 drops of x: %v", r.Dropped())
+	}
+	// The next value is recorded in full, with the number of values lost before it
+	r.DumpVar("x", 2)
+	r.Close(context.Background())
+	records, _ := sink.Records(r.SessionID(), 3, 10)
+	vardict, _ := ParseVarDict(records[0].Data)
+	if vardict["metatype"] == "unchanged" || fmt.Sprint(vardict["dropped"]) != "7" {
+		t.Errorf("expected a full value after the gap: %v", vardict)
+	}
+	sessions, _ := sink.Sessions()
+	if sessions[0].Drops["x"] != 7 {
+		t.Errorf("expected the drops in the session: %v", sessions[0])
+	}
+}
+
+func TestDropOldest(t *testing.T) {
+	r, sink := dumpWithStuckWorker(t, BackpressureDropOldest)
+	defer r.Close(context.Background())
+	if fmt.Sprint(recordedValues(t, sink, r.SessionID())) != "[0 8 9]" {
+		t.Errorf("expected the last values to be kept: %v", recordedValues(t, sink, r.SessionID()))
+	}
+	if r.Dropped()["x"] != 7 {
+		t.Errorf("expected 7 drops of x: %v", r.Dropped())
+	}
+}
+
+// The diffs queued behind an evicted record are dropped with it, up to the next full record:
+// an unchanged record always follows the record it was compared to
+func TestDropOldestCutsDiffs(t *testing.T) {
+	sink := &gatedSink{MemorySink: NewMemorySink(), gate: make(chan struct{}), entered: make(chan struct{}, 1)}
+	r, _ := NewRecorder(Configuration{MaxDepth: 5, Sink: sink, SpoolDir: t.TempDir(), QueueSize: 2, BatchSize: 1,
+		Backpressure: BackpressureDropOldest})
+	defer r.Close(context.Background())
+	r.DumpVar("x", 0)
+	<-sink.entered
+	// The third value evicts the first, leaving two unchanged records based on it
+	for i := 0; i < 3; i++ {
+		r.DumpVar("x", 1)
+	}
+	close(sink.gate)
+	r.DumpVar("x", 1)
+	r.Flush(context.Background())
+	records, _ := sink.Records(r.SessionID(), 0, 100)
+	for i, record := range records {
+		vardict, _ := ParseVarDict(record.Data)
+		if vardict["metatype"] == "unchanged" && (i == 0 || records[i-1].Sequence != record.Sequence-1) {
+			t.Errorf("record %d is unchanged from a value never stored", record.Sequence)
+		}
+	}
+	if last, _ := ParseVarDict(records[len(records)-1].Data); fmt.Sprint(last["value"]) != "1" {
+		t.Errorf("expected the value dumped after the drops to be recorded in full, got %v", last)
+	}
+}
+
+func TestLeftoverSpillsRemoved(t *testing.T) {
+	dir := t.TempDir()
+	// No process runs with the largest pid
+	leftover := filepath.Join(dir, "spill-4194304-1-1.log")
+	os.WriteFile(leftover, []byte("{}\n"), 0644)
+	s, err := newSpill(dir, &Session{ID: 2, Timestamp: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.remove()
+	if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+		t.Errorf("expected the spill file of a dead process to be removed: %v", err)
+	}
+}
+
+func TestBlock(t *testing.T) {
+	sink := &gatedSink{MemorySink: NewMemorySink(), gate: make(chan struct{}), entered: make(chan struct{}, 1)}
+	r, _ := NewRecorder(Configuration{MaxDepth: 5, Sink: sink, SpoolDir: t.TempDir(), QueueSize: 2, BatchSize: 1, Backpressure: BackpressureBlock})
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 10; i++ {
+			r.DumpVar("x", i)
+		}
+		close(done)
+	}()
+	<-sink.entered
+	close(sink.gate)
+	<-done
+	r.Close(context.Background())
+	if len(recordedValues(t, sink, r.SessionID())) != 10 || r.Dropped() != nil {
+		t.Errorf("expected every value to be recorded: %v", r.Dropped())
+	}
+}
+
+func TestSpill(t *testing.T) {
+	r, sink := dumpWithStuckWorker(t, BackpressureSpill)
+	spillFile := r.spill.file.Name()
+	r.Close(context.Background())
+	if fmt.Sprint(recordedValues(t, sink, r.SessionID())) != "[0 1 2 3 4 5 6 7 8 9]" {
+		t.Errorf("expected every value in order: %v", recordedValues(t, sink, r.SessionID()))
+	}
+	if _, err := os.Stat(spillFile); !os.IsNotExist(err) {
+		t.Errorf("expected the spill file to be removed: %v", err)
+	}
+}
+
+// The spilled records keep their gap and whether they are diffs, the frames that can not be read are skipped
+func TestSpillBadFrames(t *testing.T) {
+	s, err := newSpill(t.TempDir(), &Session{ID: 1, Timestamp: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.remove()
+	type loss struct {
+		records int
+		after   int64
+	}
+	losses := make([]loss, 0)
+	lost := func(records int, after int64, err error) {
+		losses = append(losses, loss{records, after})
+	}
+
+	s.push(queuedRecord{record: Record{Name: "x", Sequence: 1}, gap: 2, based: true})
+	// A frame read back whole, but not a record
+	frame := appendFrame(nil, []byte("not json"))
+	s.file.WriteAt(frame, s.writeOffset)
+	s.writeOffset += int64(len(frame))
+	s.queued++
+	s.push(queuedRecord{record: Record{Name: "x", Sequence: 3}})
+	for _, want := range []queuedRecord{{Record{Name: "x", Sequence: 1}, 2, true}, {Record{Name: "x", Sequence: 3}, 0, false}} {
+		item, ok := s.next(lost)
+		if !ok || item.record.Sequence != want.record.Sequence || item.gap != want.gap || item.based != want.based {
+			t.Errorf("expected %+v, got %+v %v", want, item, ok)
+		}
+		s.done()
+	}
+	if fmt.Sprint(losses) != "[{1 1}]" {
+		t.Errorf("expected the bad record to be lost after record 1: %v", losses)
+	}
+
+	// A broken frame loses the rest of the file
+	losses = losses[:0]
+	s.push(queuedRecord{record: Record{Name: "x", Sequence: 4}})
+	s.push(queuedRecord{record: Record{Name: "x", Sequence: 5}})
+	s.file.WriteAt([]byte{0xff}, frameHeaderSize)
+	s.close()
+	if item, ok := s.next(lost); ok {
+		t.Errorf("expected no record, got %+v", item)
+	}
+	if fmt.Sprint(losses) != "[{2 3}]" || s.queued != 0 {
+		t.Errorf("expected the two records to be lost after record 3: %v %d", losses, s.queued)
+	}
+}
+
+// Lost spilled records are counted, and the variables are recorded in full from their next value
+func TestLostSpilled(t *testing.T) {
+	r, sink := newTestRecorder(t)
+	r.DumpVar("x", 1)
+	r.Flush(context.Background())
+	r.pending.add(2)
+	r.lostSpilled(2, r.sequence.Load(), errBadFrame)
+	r.DumpVar("x", 1)
+	r.Close(context.Background())
+	if r.Dropped()[lostName] != 2 {
+		t.Errorf("expected 2 lost records: %v", r.Dropped())
+	}
+	if fmt.Sprint(recordedValues(t, sink, r.SessionID())) != "[1 1]" {
+		t.Errorf("expected x in full after the loss: %v", recordedValues(t, sink, r.SessionID()))
+	}
+}
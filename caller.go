@@ -0,0 +1,91 @@
+package goclear
+
+import "bytes"
+import "fmt"
+import "runtime"
+import "strconv"
+import "time"
+
+// A Caller tells where a record was dumped from: the code calling DumpVar, and its goroutine.
+// Dumps of the same variable name from different call sites are told apart by their location
+type Caller struct {
+	File     string `json:"file,omitempty"`
+	Line     int    `json:"line,omitempty"`
+	Function string `json:"function,omitempty"`
+	// The id the runtime gives the goroutine, as shown in panics and stack dumps
+	Goroutine int64 `json:"goroutine,omitempty"`
+}
+
+func (c Caller) String() string {
+	if c.File == "" {
+		return "unknown"
+	}
+	return fmt.Sprintf("%s:%d", c.File, c.Line)
+}
+
+// Where and when a record comes from, captured by the exported functions.
+// The time and sequence number are stamped when the record is ordered against the others
+type recordOrigin struct {
+	caller   Caller
+	stackID  int64
+	stack    []StackFrame
+	captured time.Time
+	sequence int64
+	// Whether the record is a diff against the last value of its variable
+	based bool
+}
+
+// The origin of a record skip frames above the caller of originOf, plus Configuration.CallerSkip.
+// The stack trace is captured when asked, or for the variables of Configuration.StackNames
+func (r *Recorder) originOf(name string, skip int, withStack bool) recordOrigin {
+	skip += 1 + r.config.CallerSkip
+	origin := recordOrigin{
+		caller: captureCaller(skip),
+	}
+	if withStack || r.wantsStack(name) {
+		origin.stackID, origin.stack = r.stacks.capture(skip)
+	}
+	return origin
+}
+
+// Give a record its capture time and sequence number
+func (r *Recorder) stamp(origin *recordOrigin) {
+	origin.captured = time.Now()
+	origin.sequence = r.sequence.Add(1)
+}
+
+func (r *Recorder) wantsStack(name string) bool {
+	for _, stackName := range r.config.StackNames {
+		if stackName == name {
+			return true
+		}
+	}
+	return false
+}
+
+// The location skip frames above the function calling captureCaller, 0 being that function
+func captureCaller(skip int) Caller {
+	caller := Caller{Goroutine: goroutineID()}
+	pcs := make([]uintptr, 1)
+	// Skip runtime.Callers and captureCaller
+	if runtime.Callers(skip+2, pcs) == 0 {
+		return caller
+	}
+	frame, _ := runtime.CallersFrames(pcs).Next()
+	caller.File = frame.File
+	caller.Line = frame.Line
+	caller.Function = frame.Function
+	return caller
+}
+
+// The id of the current goroutine, read from the header of its stack trace: "goroutine 18 [running]:"
+func goroutineID() int64 {
+	buf := make([]byte, 64)
+	buf = buf[:runtime.Stack(buf, false)]
+	buf = bytes.TrimPrefix(buf, []byte("goroutine "))
+	if end := bytes.IndexByte(buf, ' '); end > 0 {
+		buf = buf[:end]
+	}
+	id, _ := strconv.ParseInt(string(buf), 10, 64)
+	return id
+}
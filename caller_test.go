@@ -0,0 +1,73 @@
+package goclear
+
+import "context"
+import "runtime"
+import "strings"
+import "testing"
+
+// A helper wrapping DumpVar, whose caller should be recorded with CallerSkip 1
+func dumpWrapped(r *Recorder, name string, object interface{}) {
+	r.DumpVar(name, object)
+}
+
+func TestRecordCaller(t *testing.T) {
+	r, sink := newTestRecorder(t)
+	_, _, line, _ := runtime.Caller(0)
+	r.DumpVar("x", 1)
+	r.DumpVar("x", 2)
+	done := make(chan bool)
+	go func() {
+		r.DumpVar("x", 3)
+		close(done)
+	}()
+	<-done
+	dumpWrapped(r, "x", 4)
+	r.Close(context.Background())
+
+	records, _ := sink.Records(r.SessionID(), 0, 10)
+	if len(records) != 4 {
+		t.Fatalf("expected 4 records, got %d", len(records))
+	}
+	first := records[0].Caller
+	if !strings.HasSuffix(first.File, "caller_test.go") || first.Line != line+1 || !strings.HasSuffix(first.Function, ".TestRecordCaller") {
+		t.Errorf("wrong caller %+v, expected line %d of TestRecordCaller", first, line+1)
+	}
+	// The same name dumped from another line, and another goroutine
+	if records[1].Line != line+2 {
+		t.Errorf("expected line %d, got %d", line+2, records[1].Line)
+	}
+	if first.Goroutine == 0 || records[1].Goroutine != first.Goroutine || records[2].Goroutine == first.Goroutine {
+		t.Errorf("wrong goroutines %d %d %d", first.Goroutine, records[1].Goroutine, records[2].Goroutine)
+	}
+	if records[3].Function != "github.com/RealHacker/goclear.dumpWrapped" {
+		t.Errorf("without skip, the wrapper should be recorded, got %s", records[3].Function)
+	}
+}
+
+func TestCallerSkip(t *testing.T) {
+	sink := NewMemorySink()
+	r, err := NewRecorder(Configuration{MaxDepth: 5, Sink: sink, SpoolDir: t.TempDir(), CallerSkip: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, line, _ := runtime.Caller(0)
+	dumpWrapped(r, "x", 1)
+	r.Close(context.Background())
+
+	records, _ := sink.Records(r.SessionID(), 0, 10)
+	if len(records) != 1 || records[0].Line != line+1 || !strings.HasSuffix(records[0].Function, ".TestCallerSkip") {
+		t.Errorf("expected the caller of the wrapper, got %+v", records)
+	}
+}
+
+func TestGoroutineID(t *testing.T) {
+	id := goroutineID()
+	if id <= 0 {
+		t.Fatalf("expected a goroutine id, got %d", id)
+	}
+	other := make(chan int64)
+	go func() { other <- goroutineID() }()
+	if <-other == id {
+		t.Error("two goroutines should have distinct ids")
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import "flag"
+import "fmt"
+import "os"
+import "strings"
+import "github.com/RealHacker/goclear"
+
+func usage() {
+	fmt.Println("Usage: goclear migrate [-backend mysql] [-path root@/goclear]")
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	switch os.Args[1] {
+	case "migrate":
+		migrate(os.Args[2:])
+	default:
+		usage()
+	}
+}
+
+// Bring the database of a backend to the latest schema
+func migrate(args []string) {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	backend := flags.String("backend", "mysql", "backend storing the sessions: "+strings.Join(goclear.MigrationBackends(), ", "))
+	DBPath := flags.String("path", "root@/goclear", "path of the backend storage")
+	flags.Parse(args)
+
+	applied, version, err := goclear.Migrate(*backend, *DBPath)
+	for _, migration := range applied {
+		fmt.Printf("Applied migration %d: %s\n", migration.Version, migration.Description)
+	}
+	if err != nil {
+		fmt.Println("Fail to migrate the database:", err)
+		os.Exit(1)
+	}
+	fmt.Println("Schema version", version)
+}
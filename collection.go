@@ -0,0 +1,109 @@
+package goclear
+
+import "container/list"
+import "container/ring"
+import "reflect"
+import "sync"
+
+// Collections whose internal structure is a tangle of pointers are dumped as
+// the logical sequence of their elements instead:
+//	{
+//		metatype: "sequence",
+//		len: number of elements,
+//		value: [ element VarDicts, in order ]
+//	}
+// sync.Map is dumped like a regular map, read through Range.
+// Heaps from container/heap are usually backed by a slice, which is already
+// dumped in heap order; other heaps can implement Sequencer.
+
+// Sequencer is implemented by types that should be dumped as the ordered list
+// of their elements, e.g. user defined linked lists or trees
+type Sequencer interface {
+	Elements() []interface{}
+}
+
+var sequencerType = reflect.TypeOf((*Sequencer)(nil)).Elem()
+
+// RegisterSequence makes values of the same type as sample be dumped as sequences.
+// This is meant for types to which an Elements method can't be added.
+// The elements function receives a pointer to the value being dumped
+func RegisterSequence(sample interface{}, elements func(obj interface{}) []interface{}) {
+	registerRenderer(reflect.TypeOf(sample), func(w *walker, v reflect.Value, depth int) VarDict {
+		return w.newSequenceVarDict(elements(v.Addr().Interface()), depth)
+	})
+}
+
+func init() {
+	RegisterSequence(list.List{}, listElements)
+	RegisterSequence(ring.Ring{}, ringElements)
+	registerRenderer(reflect.TypeOf(sync.Map{}), renderSyncMap)
+	registerRendererMatcher(func(t reflect.Type) renderer {
+		// Pointers are followed first, their target is then rendered
+		if t.Kind() == reflect.Ptr || t.Kind() == reflect.Interface {
+			return nil
+		}
+		if t.Implements(sequencerType) || reflect.PtrTo(t).Implements(sequencerType) {
+			return renderSequencer
+		}
+		return nil
+	})
+}
+
+func (w *walker) newSequenceVarDict(elements []interface{}, depth int) VarDict {
+	vardict := NewVarDict()
+	vardict.SetMeta("sequence")
+	vardict.SetField("len", len(elements))
+	varDictArray := make([]VarDict, len(elements))
+	for i, element := range elements {
+		varDictArray[i] = w.walk(element, depth+1)
+	}
+	vardict.SetValue(varDictArray)
+	return vardict
+}
+
+func renderSequencer(w *walker, v reflect.Value, depth int) VarDict {
+	sequencer, ok := v.Interface().(Sequencer)
+	if !ok {
+		sequencer = v.Addr().Interface().(Sequencer)
+	}
+	return w.newSequenceVarDict(sequencer.Elements(), depth)
+}
+
+func listElements(obj interface{}) []interface{} {
+	l := obj.(*list.List)
+	elements := make([]interface{}, 0, l.Len())
+	for e := l.Front(); e != nil; e = e.Next() {
+		elements = append(elements, e.Value)
+	}
+	return elements
+}
+
+func ringElements(obj interface{}) []interface{} {
+	r := obj.(*ring.Ring)
+	// When r is a copy, walking from it would never come back to it,
+	// so start from the original element in the ring
+	r = r.Next().Prev()
+	elements := make([]interface{}, 0)
+	elements = append(elements, r.Value)
+	for p := r.Next(); p != r; p = p.Next() {
+		elements = append(elements, p.Value)
+	}
+	return elements
+}
+
+// sync.Map is read through Range, and dumped like a map
+func renderSyncMap(w *walker, v reflect.Value, depth int) VarDict {
+	vardict := NewVarDict()
+	vardict.SetMeta("map")
+	varDictArray := make([]KeyValuePair, 0)
+	v.Addr().Interface().(*sync.Map).Range(func(key, value interface{}) bool {
+		kv := make(KeyValuePair)
+		kv.setKey(w.walk(key, depth+1))
+		kv.setValue(w.walk(value, depth+1))
+		varDictArray = append(varDictArray, kv)
+		return true
+	})
+	vardict.SetField("len", len(varDictArray))
+	vardict.SetValue(varDictArray)
+	return vardict
+}
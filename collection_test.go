@@ -0,0 +1,89 @@
+package goclear
+
+import "testing"
+import "container/list"
+import "container/ring"
+import "sync"
+
+func sequenceValues(vd VarDict) []interface{} {
+	values := make([]interface{}, 0)
+	for _, element := range vd["value"].([]VarDict) {
+		values = append(values, element["value"])
+	}
+	return values
+}
+
+func checkSequence(t *testing.T, vd VarDict, expected ...interface{}) {
+	if vd["metatype"] != "sequence" || vd["len"] != len(expected) {
+		t.Fatalf("expected a sequence of %d elements, got %v", len(expected), vd)
+	}
+	for i, value := range sequenceValues(vd) {
+		if value != expected[i] {
+			t.Errorf("element %d: expected %v, got %v", i, expected[i], value)
+		}
+	}
+}
+
+func TestDumpList(t *testing.T) {
+	l := list.New()
+	l.PushBack(1)
+	l.PushBack(2)
+	l.PushFront(0)
+	checkSequence(t, GetVarDict("l", l)["value"].(VarDict), 0, 1, 2)
+	checkSequence(t, GetVarDict("l", *l), 0, 1, 2)
+}
+
+func TestDumpRing(t *testing.T) {
+	r := ring.New(3)
+	for i := 0; i < 3; i++ {
+		r.Value = i
+		r = r.Next()
+	}
+	checkSequence(t, GetVarDict("r", r)["value"].(VarDict), 0, 1, 2)
+	// Walking a copy must terminate as well
+	checkSequence(t, GetVarDict("r", *r.Next()), 1, 2, 0)
+}
+
+func TestDumpSyncMap(t *testing.T) {
+	var m sync.Map
+	m.Store("a", 1)
+	m.Store("b", 2)
+	vd := GetVarDict("m", &m)["value"].(VarDict)
+	if vd["metatype"] != "map" || vd["len"] != 2 {
+		t.Fatalf("expected a map of 2 entries, got %v", vd)
+	}
+	for _, kv := range vd["value"].([]KeyValuePair) {
+		key := kv["key"].(VarDict)["value"]
+		value, _ := m.Load(key)
+		if kv["value"].(VarDict)["value"] != value {
+			t.Errorf("unexpected entry %v", kv)
+		}
+	}
+}
+
+// A linked structure opting into sequence rendering
+type chain struct {
+	Value int
+	next  *chain
+}
+
+func (c *chain) Elements() []interface{} {
+	elements := make([]interface{}, 0)
+	for p := c; p != nil; p = p.next {
+		elements = append(elements, p.Value)
+	}
+	return elements
+}
+
+func TestDumpSequencer(t *testing.T) {
+	c := &chain{1, &chain{2, &chain{3, nil}}}
+	checkSequence(t, GetVarDict("c", c)["value"].(VarDict), 1, 2, 3)
+
+	type Holder struct {
+		items list.List
+	}
+	h := &Holder{}
+	h.items.PushBack("x")
+	items := GetVarDict("h", h)["value"].(VarDict)["value"].(map[string]interface{})["items"]
+	checkSequence(t, items.(VarDict), "x")
+}
@@ -1,14 +1,114 @@
 package goclear
 
+import "fmt"
+import "os"
+import "path/filepath"
+import "time"
+
 type Configuration struct {
 	MaxDepth int
+	// The registered backend (mysql, memory, jsonl...) opened with DBPath, unless Sink is set
+	Backend string
 	DBPath string
+	Sink Sink
+	// Names a custom Sink in the spool files, so that a later run with the same SinkName
+	// replays the records it failed to save; without it, only this run retries them
+	SinkName string
+	// Workers writing to the sink; with more than one, records may be written out of order
+	Workers int
+	// VarDicts waiting for a worker
+	QueueSize int
+	// A worker writes its batch when it holds BatchSize records, or FlushInterval after the first one
+	BatchSize int
+	FlushInterval time.Duration
+	// What PostRecord does when the queue is full, drop-newest by default
+	Backpressure Backpressure
+	// Where the spill backpressure policy writes its files, by default a directory
+	// of the user cache directory that only the user can read
+	SpillDir string
+	// Where records are kept while the sink fails, retried after RetryInterval,
+	// then twice as long after each failure, up to MaxRetryInterval. By default the same as SpillDir
+	SpoolDir string
+	RetryInterval time.Duration
+	MaxRetryInterval time.Duration
+	// Whether Start installs handlers for SIGHUP, SIGINT and SIGTERM that close the recorder and exit
+	HandleSignals bool
+	// Called with a *RecordError for the failures that happen after DumpVar returned,
+	// from the goroutines of the recorder: it should not block
+	OnError func(err error)
+	// Frames skipped above the caller of DumpVar when recording where a record comes from:
+	// 1 records the caller of a function wrapping DumpVar
+	CallerSkip int
+	// Variables whose dumps record the stack trace of the call, like DumpVarWithStack
+	StackNames []string
+	// Environment variables stored in the session metadata, names or prefixes ending with *
+	EnvAllowlist []string
+	// Free labels stored in the session metadata, e.g. the name of a test run
+	Labels map[string]string
 }
 
+// The default configuration, for Start to be given. Start never changes it:
+// it is read by the package level functions only until Start is called
 var Config Configuration
 
 func InitializeConfig() {
 	// These will come from a configuration file
 	Config.MaxDepth = 5
+	Config.Backend = "mysql"
 	Config.DBPath = "root@/goclear"
+	Config.Workers = 1
+	Config.QueueSize = 100
+	Config.BatchSize = 100
+	Config.FlushInterval = 100 * time.Millisecond
+	Config.Backpressure = BackpressureDropNewest
+	Config.SpillDir = defaultDataDir()
+	Config.SpoolDir = defaultDataDir()
+	Config.RetryInterval = 100 * time.Millisecond
+	Config.MaxRetryInterval = 30 * time.Second
+}
+
+// The directory of the spill and spool files of the current user, created 0700 when used:
+// goclear in the user cache directory, or a directory of the user in the temporary one
+func defaultDataDir() string {
+	if cache, err := os.UserCacheDir(); err == nil {
+		return filepath.Join(cache, "goclear")
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("goclear-%d", os.Getuid()))
+}
+
+// Fill the worker settings left to zero with the defaults
+func (config Configuration) withDefaults() Configuration {
+	if config.Workers <= 0 {
+		config.Workers = 1
+	}
+	if config.QueueSize <= 0 {
+		config.QueueSize = 100
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = 100
+	}
+	if config.FlushInterval <= 0 {
+		config.FlushInterval = 100 * time.Millisecond
+	}
+	if config.Backpressure == "" {
+		config.Backpressure = BackpressureDropNewest
+	}
+	if config.SpillDir == "" {
+		config.SpillDir = defaultDataDir()
+	}
+	if config.SpoolDir == "" {
+		config.SpoolDir = defaultDataDir()
+	}
+	if config.RetryInterval <= 0 {
+		config.RetryInterval = 100 * time.Millisecond
+	}
+	if config.MaxRetryInterval <= 0 {
+		config.MaxRetryInterval = 30 * time.Second
+	}
+	return config
+}
+
+// The package does nothing but set up the default configuration until Start is called
+func init() {
+	InitializeConfig()
 }
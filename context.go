@@ -0,0 +1,178 @@
+package goclear
+
+import "context"
+import "reflect"
+import "time"
+import "unsafe"
+
+// A context.Context is dumped as the list of its layers, from the context
+// itself up to the root (Background/TODO):
+//	{
+//		metatype: "context",
+//		type: "concrete type of the outermost context",
+//		len: number of layers,
+//		value: [ layer VarDicts ]
+//	}
+// Each layer is a VarDict of metatype "ctxlayer", whose value maps
+// kind/deadline/remaining/err/cause (and key/value for a value layer) to VarDicts.
+// Only the contexts of the standard library are dumped this way: other types implementing
+// Context are walked like any value, their embedded Context being a chain of its own.
+// The time remaining before a deadline is counted from the capture of the value;
+// Compare leaves it out, it would make every dump differ
+
+var contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+
+// Map the concrete context types of the standard library to layer kinds
+var contextKinds = map[string]string{
+	"*context.cancelCtx":       "cancel",
+	"*context.timerCtx":        "timeout",
+	"*context.valueCtx":        "value",
+	"*context.afterFuncCtx":    "afterfunc",
+	"*context.stopCtx":         "stop",
+	"context.withoutCancelCtx": "withoutcancel",
+	"context.backgroundCtx":    "background",
+	"context.todoCtx":          "todo",
+	"*context.emptyCtx":        "empty",
+}
+
+// The context held by v, if it is a context of the standard library
+func contextOf(v reflect.Value) (context.Context, bool) {
+	if _, ok := contextKinds[v.Type().String()]; !ok || !v.CanInterface() {
+		return nil, false
+	}
+	// A nil pointer implementing Context can not be asked for anything
+	if v.Kind() == reflect.Ptr && v.IsNil() {
+		return nil, false
+	}
+	return v.Interface().(context.Context), true
+}
+
+// Get the kind of a single context layer
+func contextKind(ctx context.Context) string {
+	kind, ok := contextKinds[reflect.TypeOf(ctx).String()]
+	if !ok {
+		return "custom"
+	}
+	return kind
+}
+
+// Read a struct field even if it is unexported
+func readField(field reflect.Value) interface{} {
+	if field.CanInterface() {
+		return field.Interface()
+	}
+	return reflect.NewAt(field.Type(), unsafe.Pointer(field.UnsafeAddr())).Elem().Interface()
+}
+
+// Make sure we have an addressable struct to read unexported fields from
+func addressableStruct(obj interface{}) (reflect.Value, bool) {
+	v := reflect.ValueOf(obj)
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return v, false
+		}
+		v = v.Elem()
+	} else {
+		copied := reflect.New(v.Type()).Elem()
+		copied.Set(v)
+		v = copied
+	}
+	return v, v.Kind() == reflect.Struct
+}
+
+// Find the parent of a context layer: the first field of type context.Context,
+// looking into embedded structs as well (timerCtx embeds a cancelCtx)
+func findContextField(v reflect.Value) (context.Context, bool) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := v.Field(i)
+		if t.Field(i).Type == contextType {
+			parent, _ := readField(field).(context.Context)
+			return parent, parent != nil
+		}
+		if t.Field(i).Anonymous && field.Kind() == reflect.Struct {
+			if parent, ok := findContextField(field); ok {
+				return parent, true
+			}
+		}
+	}
+	return nil, false
+}
+
+func contextParent(ctx context.Context) (context.Context, bool) {
+	v, ok := addressableStruct(ctx)
+	if !ok {
+		return nil, false
+	}
+	return findContextField(v)
+}
+
+// A value layer keeps its key and value in unexported fields "key" and "val"
+func contextKeyValue(ctx context.Context) (interface{}, interface{}, bool) {
+	v, ok := addressableStruct(ctx)
+	if !ok {
+		return nil, nil, false
+	}
+	key, val := v.FieldByName("key"), v.FieldByName("val")
+	if !key.IsValid() || !val.IsValid() {
+		return nil, nil, false
+	}
+	return readField(key), readField(val), true
+}
+
+// Generate the VarDict for a single layer of context
+func (w *walker) getContextLayerVarDict(ctx context.Context, depth int) VarDict {
+	vardict := NewVarDict()
+	vardict.SetType(reflect.TypeOf(ctx).String())
+	vardict.SetMeta("ctxlayer")
+
+	kind := contextKind(ctx)
+	fields := make(map[string]interface{})
+	fields["kind"] = w.walk(kind, depth+1)
+	if deadline, ok := ctx.Deadline(); ok {
+		fields["deadline"] = w.walk(deadline.Format(time.RFC3339Nano), depth+1)
+		fields["remaining"] = w.walk(deadline.Sub(w.now).String(), depth+1)
+	}
+	if err := ctx.Err(); err != nil {
+		fields["err"] = w.walk(err.Error(), depth+1)
+		if cause := context.Cause(ctx); cause != nil && cause != err {
+			fields["cause"] = w.walk(cause.Error(), depth+1)
+		}
+	}
+	if kind == "value" {
+		if key, val, ok := contextKeyValue(ctx); ok {
+			keyVarDict := w.walk(key, depth+1)
+			if key != nil {
+				keyVarDict.SetType(reflect.TypeOf(key).String())
+			}
+			fields["key"] = keyVarDict
+			fields["value"] = w.walk(val, depth+1)
+		}
+	}
+	vardict.SetValue(fields)
+	return vardict
+}
+
+// Generate a VarDict for a context, walking the chain of parents
+func GetVarDictFromContext(ctx context.Context, depth int) VarDict {
+	return newWalker(defaultMaxDepth()).walkContext(ctx, depth)
+}
+
+func (w *walker) walkContext(ctx context.Context, depth int) VarDict {
+	vardict := NewVarDict()
+	vardict.SetType(reflect.TypeOf(ctx).String())
+	vardict.SetMeta("context")
+
+	layers := make([]VarDict, 0)
+	for ctx != nil {
+		layers = append(layers, w.getContextLayerVarDict(ctx, depth))
+		parent, ok := contextParent(ctx)
+		if !ok {
+			break
+		}
+		ctx = parent
+	}
+	vardict.SetField("len", len(layers))
+	vardict.SetValue(layers)
+	return vardict
+}
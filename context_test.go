@@ -0,0 +1,115 @@
+package goclear
+
+import "testing"
+import "context"
+import "errors"
+import "time"
+
+type ctxKey string
+
+func layerField(layer VarDict, name string) interface{} {
+	field, ok := layer["value"].(map[string]interface{})[name]
+	if !ok {
+		return nil
+	}
+	return field.(VarDict)["value"]
+}
+
+func TestDumpContext(t *testing.T) {
+	root, cancel := context.WithCancelCause(context.Background())
+	valued := context.WithValue(root, ctxKey("user"), "alice")
+	timed, stop := context.WithTimeout(valued, time.Hour)
+	defer stop()
+	cancel(errors.New("shutting down"))
+
+	vd := GetVarDict("ctx", timed)
+	if vd["metatype"] != "context" {
+		t.Fatalf("expected context metatype, got %v", vd["metatype"])
+	}
+	layers := vd["value"].([]VarDict)
+	kinds := []string{"timeout", "value", "cancel", "background"}
+	if len(layers) != len(kinds) || vd["len"] != len(kinds) {
+		t.Fatalf("expected %d layers, got %d", len(kinds), len(layers))
+	}
+	for i, kind := range kinds {
+		if k := layerField(layers[i], "kind"); k != kind {
+			t.Errorf("layer %d: expected kind %s, got %v", i, kind, k)
+		}
+	}
+	if layerField(layers[0], "deadline") == nil {
+		t.Error("timeout layer should have a deadline")
+	}
+	remaining, err := time.ParseDuration(layerField(layers[0], "remaining").(string))
+	if err != nil || remaining <= 59*time.Minute || remaining > time.Hour {
+		t.Errorf("expected about an hour remaining, got %v %v", remaining, err)
+	}
+	if err := layerField(layers[0], "err"); err != "context canceled" {
+		t.Errorf("expected cancelled timeout layer, got %v", err)
+	}
+	if cause := layerField(layers[2], "cause"); cause != "shutting down" {
+		t.Errorf("expected cause to be recorded, got %v", cause)
+	}
+	key := layers[1]["value"].(map[string]interface{})["key"].(VarDict)
+	if key["type"] != "goclear.ctxKey" || key["value"] != ctxKey("user") {
+		t.Errorf("unexpected key VarDict %v", key)
+	}
+	if v := layerField(layers[1], "value"); v != "alice" {
+		t.Errorf("unexpected value %v", v)
+	}
+	if layerField(layers[3], "err") != nil {
+		t.Error("background layer should not be cancelled")
+	}
+}
+
+func TestDumpContextField(t *testing.T) {
+	type Request struct {
+		Ctx context.Context
+	}
+	vd := GetVarDict("req", Request{context.TODO()})
+	field := vd["value"].(map[string]interface{})["Ctx"].(VarDict)
+	if field["metatype"] != "context" || field["len"] != 1 {
+		t.Errorf("unexpected context field %v", field)
+	}
+	// Comparing two dumps of the same context should not panic
+	again := GetVarDict("req", Request{context.TODO()})
+	if !again.Compare(vd) {
+		t.Error("the same context should compare unchanged")
+	}
+}
+
+// A type implementing Context by embedding one keeps its own fields
+func TestDumpCustomContext(t *testing.T) {
+	type Job struct {
+		context.Context
+		Body string
+	}
+	vd := GetVarDict("job", Job{context.Background(), "payload"})
+	if vd["metatype"] != "struct" {
+		t.Fatalf("expected a struct, got %v", vd["metatype"])
+	}
+	fields := vd["value"].(map[string]interface{})
+	if fields["Body"].(VarDict)["value"] != "payload" {
+		t.Errorf("expected the Body field, got %v", fields["Body"])
+	}
+	if embedded := fields["Context"].(VarDict); embedded["metatype"] != "context" {
+		t.Errorf("expected the embedded context as a chain, got %v", embedded)
+	}
+}
+
+// Dumps of a context with a deadline compare unchanged until it changes
+func TestCompareDeadlineContext(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+	first := GetVarDict("ctx", ctx)
+	time.Sleep(time.Millisecond)
+	second := GetVarDict("ctx", ctx)
+	if layerField(second["value"].([]VarDict)[0], "remaining") == layerField(first["value"].([]VarDict)[0], "remaining") {
+		t.Error("expected the remaining time to count down")
+	}
+	if !second.Compare(first) {
+		t.Error("a deadline context should compare unchanged")
+	}
+	cancel()
+	if GetVarDict("ctx", ctx).Compare(first) {
+		t.Error("a cancelled context should compare changed")
+	}
+}
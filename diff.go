@@ -1,6 +1,7 @@
 package goclear
 
-import "fmt"
+import "math"
+import "sync"
 
 func getUnchangedVarDict() VarDict {
 	dict := make(VarDict)
@@ -31,6 +32,24 @@ func GetValueType(v interface{}) string{
 	return t
 }
 
+// Compare basic values, considering a NaN unchanged if it is still NaN
+func sameValue(v1 interface{}, v2 interface{}) bool {
+	if v1 == v2 {
+		return true
+	}
+	f1, ok1 := v1.(float64)
+	f2, ok2 := v2.(float64)
+	if !ok1 || !ok2 {
+		f32a, ok1 := v1.(float32)
+		f32b, ok2 := v2.(float32)
+		f1, f2 = float64(f32a), float64(f32b)
+		if !ok1 || !ok2 {
+			return false
+		}
+	}
+	return math.IsNaN(f1) && math.IsNaN(f2)
+}
+
 func minInt (len1 int, len2 int) int {
 	if len1<=len2{
 		return len1
@@ -61,7 +80,7 @@ func (vardict VarDict) Compare(last VarDict) bool{
 	}
 	// Deal with various types
 	switch vardict["metatype"] {
-	case "ptr":
+	case "ptr", "atomic":
 		if t1 == "string" { // 2 null pointers
 			return false
 		}
@@ -69,7 +88,12 @@ func (vardict VarDict) Compare(last VarDict) bool{
 		ptrVarDict1 := vardict["value"].(VarDict)	
 		ptrVarDict2 := last["value"].(VarDict)
 		return ptrVarDict1.Compare(ptrVarDict2) 
-	case "array", "slice":
+	case "array", "slice", "context", "sequence":
+		// A slice whose data moved was reallocated, rather than modified in place
+		reallocated := vardict["data"] != last["data"]
+		if reallocated {
+			vardict.SetField("reallocated", true)
+		}
 		len1 := vardict["len"].(int)
 		len2 := last["len"].(int)
 		minlen := minInt(len1, len2)
@@ -83,7 +107,7 @@ func (vardict VarDict) Compare(last VarDict) bool{
 				children1[i] = getUnchangedVarDict()
 			}
 		}
-		if allSame && len1==len2 {
+		if allSame && len1==len2 && !reallocated {
 			return true
 		}
 		return false
@@ -114,12 +138,16 @@ func (vardict VarDict) Compare(last VarDict) bool{
 			return true
 		}
 		return false
-	case "struct":
+	case "struct", "ctxlayer", "sync":
 		map1 := vardict["value"].(map[string]interface{})
 		map2 := last["value"].(map[string]interface{})
 		len1, len2 := len(map1), len(map2)
 		allSame := true
 		for k, v1 := range map1 {
+			// The time remaining before the deadline of a context changes with every dump
+			if k == "remaining" && vardict["metatype"] == "ctxlayer" {
+				continue
+			}
 			v2, exists := map2[k]
 			if !exists {
 				allSame = false
@@ -144,38 +172,86 @@ func (vardict VarDict) Compare(last VarDict) bool{
 			return true
 		}
 		return false
+	case "ref":
+		return vardict["$ref"] == last["$ref"]
 	default:
-		return vardict["value"]==last["value"]
+		return sameValue(vardict["value"], last["value"])
 	}
 
 }
 
-var LastVarDict map[string]*VarDict
+// The last VarDict dumped for each variable name, guarded for concurrent DumpVar calls
+type lastValueStore struct {
+	mu     sync.Mutex
+	values map[string]VarDict
+}
+
+func newLastValueStore() *lastValueStore {
+	return &lastValueStore{values: make(map[string]VarDict)}
+}
 
-func DumpVar(name string, object interface{}) error {
-	// First check if LastVarDict is initialized
-	if LastVarDict == nil {
-		LastVarDict = make(map[string]*VarDict)
+// Compare vardict with the last value of the same name, and keep it as the new last value.
+// Return the vardict to record: pruned to the diff, or an "unchanged" vardict,
+// and whether it was compared to a last value.
+// stamp, if not nil, is called under the lock, so that the order it gives follows the diff chain
+func (store *lastValueStore) diff(name string, vardict VarDict, stamp func()) (VarDict, bool) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if stamp != nil {
+		stamp()
 	}
-	vardict := GetVarDict(name, object)
-	
 	// If has last value, compare first
-	last, ok := LastVarDict[name]
+	last, ok := store.values[name]
 	var nextLast VarDict
 	if ok {
 		// If need to compare, make a clone
 		nextLast = vardict.Clone()
-		unchanged := vardict.Compare(*last)
+		unchanged := vardict.Compare(last)
 		if unchanged {
 			vardict = getUnchangedVarDict() 
 		}
+		logDebug("Compared with the last value", "name", name, "unchanged", unchanged)
 	} else {
 		nextLast = vardict
 	}
-	fmt.Println(LastVarDict)
-	// Put the current vardict in LastVarDict
-	LastVarDict[name] = &nextLast
-	PostRecord(&vardict)	
-	return nil
+	// Put the current vardict in the store
+	store.values[name] = nextLast
+	return vardict, ok
 }
 
+// Forget the last value of a variable, so that the next one is recorded in full
+func (store *lastValueStore) forget(name string) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	delete(store.values, name)
+}
+
+// Forget the last values of all the variables, and return their names
+func (store *lastValueStore) forgetAll() []string {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	names := make([]string, 0, len(store.values))
+	for name := range store.values {
+		names = append(names, name)
+	}
+	store.values = make(map[string]VarDict)
+	return names
+}
+
+// DumpVar records a variable with the recorder created by Start
+func DumpVar(name string, object interface{}) error {
+	r := getDefaultRecorder()
+	if r == nil {
+		return ErrNotStarted
+	}
+	return r.dumpVar(name, object, r.originOf(name, 1, false))
+}
+
+// DumpVarWithStack records a variable and the stack trace of the call with the recorder created by Start
+func DumpVarWithStack(name string, object interface{}) error {
+	r := getDefaultRecorder()
+	if r == nil {
+		return ErrNotStarted
+	}
+	return r.dumpVar(name, object, r.originOf(name, 1, true))
+}
@@ -1,7 +1,10 @@
 package goclear
 
 import "testing"
+import "context"
 import "fmt"
+import "sort"
+import "sync"
 
 func _simple() {
 	i1 := 4
@@ -107,3 +110,70 @@ func TestCompare(t *testing.T){
 	_struct()
 }
 
+
+// Goroutines dumping through one recorder, some under the same name, others each their own:
+// the records of each name decode to the values dumped, in order
+func TestConcurrentDumpVar(t *testing.T) {
+	type Job struct {
+		ID    int
+		Tags  []string
+		Attrs map[string]int
+		Next  *Job
+	}
+	shared := &Job{ID: 0, Tags: []string{"shared"}, Attrs: map[string]int{"a": 1}}
+	shared.Next = shared
+
+	sink := NewMemorySink()
+	r, err := NewRecorder(Configuration{MaxDepth: 5, Sink: sink, SpoolDir: t.TempDir(), Workers: 4,
+		Backpressure: BackpressureBlock})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const goroutines, dumps = 16, 50
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < dumps; i++ {
+				job := &Job{ID: i, Tags: []string{"t"}, Attrs: map[string]int{"g": g}, Next: shared}
+				r.DumpVar("shared", shared)
+				r.DumpVar(fmt.Sprintf("job%d", g), job)
+			}
+		}(g)
+	}
+	wg.Wait()
+	r.Close(context.Background())
+
+	all, _ := sink.Records(r.SessionID(), 0, 2*goroutines*dumps)
+	sort.Slice(all, func(i, j int) bool { return all[i].Sequence < all[j].Sequence })
+	byName := make(map[string][]Record)
+	for _, record := range all {
+		byName[record.Name] = append(byName[record.Name], record)
+	}
+	for g := 0; g < goroutines; g++ {
+		records := byName[fmt.Sprintf("job%d", g)]
+		if len(records) != dumps {
+			t.Fatalf("job%d: expected %d records, got %d", g, dumps, len(records))
+		}
+		for i, record := range records {
+			vardict, err := ParseVarDict(record.Data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fields := vardict["value"].(VarDict)["value"].(map[string]interface{})
+			if id := fields["ID"].(VarDict)["value"]; fmt.Sprint(id) != fmt.Sprint(i) {
+				t.Errorf("job%d: record %d has ID %v", g, i, id)
+			}
+		}
+	}
+	records := byName["shared"]
+	if len(records) != goroutines*dumps {
+		t.Fatalf("expected %d records of shared, got %d", goroutines*dumps, len(records))
+	}
+	for _, record := range records[1:] {
+		if vardict, _ := ParseVarDict(record.Data); vardict["metatype"] != "unchanged" {
+			t.Errorf("expected shared to be unchanged, got %v", vardict)
+		}
+	}
+}
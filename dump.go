@@ -4,15 +4,20 @@
 		name: "variable name",
 		type: "specific variable type - mostly user defined",
 		metatype: "type of type - map/slice/struct/ptr/int..."
+		kind: "exact kind of a number - int8/uint64/float32...",
 		address: "address of variable, available for slice/array/struct/map",
+		id: "identity of an addressable node, see graph.go",
+		data: "address of the first element of a slice, see alias.go for aliasing",
 		value: depending on type, could be a list/object with embeded variables:
 			for a slice/array - a JSON list of VarDicts
 			for a struct - a dict mapping from string (field name) to VarDicts
 			for a map - a JSON list like [{key: key Vardict, value:value VarDict}]
 			for a pointer - the VarDict of variable it points to
-			for basic type - the value itself
+			for a context - a JSON list of VarDicts, one per layer of the parent chain
+			for a sequence (list/ring/Sequencer) - a JSON list of element VarDicts
+			for basic type - the value itself, numbers encoded as described in encoding.go
 			for a NULL pointer - "#NULL#"
-			for a variable visited through another pointer - "#VISITED#"
+			for a variable visited through another pointer - nil, with "$ref" set to the id of the first visit
 			for a node too deeply recursed - "#DEPTH_EXCEEDED#""
 	}
 */
@@ -21,11 +26,7 @@ package goclear
 import "reflect"
 import "encoding/json"
 import "fmt"
-
-func printLog(args ...interface{}) {
-	// TODO: write some logging utility
-	fmt.Println(args...)
-}
+import "time"
 
 type KeyValuePair map[string]interface{}
 
@@ -40,12 +41,20 @@ func (kv KeyValuePair) setValue(obj interface{}) {
 type VarDict map[string]interface{}
 
 func (dict VarDict) Dump() string {
-	v, err := json.MarshalIndent(dict, "-", "  ")
+	v, err := dict.Encode()
 	if err != nil {
-		printLog("ERROR when marshalling into JSON:", dict)
-		return ""
+		logError("Fail to marshal VarDict into JSON", "name", dict["name"], "error", err)
 	}
-	return string(v)
+	return v
+}
+
+// Encode is Dump, returning the marshalling error
+func (dict VarDict) Encode() (string, error) {
+	v, err := json.MarshalIndent(dict.encodable(), "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(v), nil
 }
 
 // Make a deep copy of VarDict
@@ -115,6 +124,16 @@ func (dict VarDict) SetAddress(val string) {
 	dict["address"] = val
 }
 
+func (dict VarDict) SetID(val string) {
+	dict["id"] = val
+}
+
+// Identify an addressable node by its address, and an id stable across dumps
+func (dict VarDict) SetIdentity(ptr uintptr, t reflect.Type) {
+	dict.SetAddress(fmt.Sprintf("%d", ptr))
+	dict.SetID(nodeID(ptr, t))
+}
+
 func (dict VarDict) SetValue(val interface{}) {
 	dict["value"] = val
 }
@@ -141,41 +160,90 @@ func needsPtrForKind(kind reflect.Kind) bool {
 	}
 }
 
-// This cache serves 2 purpose:
+// A walker holds the state of a single dump, so that concurrent dumps don't interfere.
+// The visited nodes, keyed by address and type, serve 2 purposes:
 // 1. Avoid entering a pointer loop when recursing
 // 2. Avoid dumping an object already visited with pointer
-var PointerCache []int64
+type walker struct {
+	maxDepth int
+	visited  map[visitKey]bool
+	// Slices seen, to find the ones sharing a backing array
+	slices []sliceNode
+	// When the value is captured, the time remaining before a deadline counts from it
+	now time.Time
+}
+
+func newWalker(maxDepth int) *walker {
+	return &walker{maxDepth: maxDepth, visited: make(map[visitKey]bool), now: time.Now()}
+}
+
+// Mark a node as visited, return whether it is the first visit
+func (w *walker) visit(key visitKey) bool {
+	if w.visited[key] {
+		return false
+	}
+	w.visited[key] = true
+	return true
+}
 
-// The entry point for generating a VarDict
-// It determines whether to call GetVarDictFromPtr or GetVarDictFromValue
+// The entry point for generating a VarDict, with the depth limit of the default recorder,
+// or of Config before Start
 func GetVarDict(name string, obj interface{}) VarDict {
-	// Get a clean pointer cache
-	PointerCache = make([]int64, 32)
+	return getVarDict(name, obj, defaultMaxDepth())
+}
 
-	vardict := GetVarDictFromValue(obj, 0)
+func getVarDict(name string, obj interface{}, maxDepth int) VarDict {
+	w := newWalker(maxDepth)
+	vardict := w.walk(obj, 0)
+	w.analyzeAliases()
 	vardict.SetName(name)
 	return vardict
 }
 
-//
-// Generate a VarDict for the object itself, for basic types like int, string, and pointer
+// Generate a VarDict for the object itself, for basic types like int, string, and pointer.
+// Each call tracks visited nodes on its own; use GetVarDict for a whole variable
 func GetVarDictFromValue(variable interface{}, depth int) VarDict {
+	w := newWalker(defaultMaxDepth())
+	vardict := w.walk(variable, depth)
+	w.analyzeAliases()
+	return vardict
+}
+
+func (w *walker) walk(variable interface{}, depth int) VarDict {
+	return w.walkValue(reflect.ValueOf(variable), depth)
+}
+
+// Generate a VarDict for a value reached through reflection. The targets of pointers, their
+// fields and elements are walked in place, never copied, so that the renderers load atomics
+// and sync primitives from the original memory
+func (w *walker) walkValue(v reflect.Value, depth int) VarDict {
 	vardict := NewVarDict()
 
-	if variable == nil {
+	// An interface is walked as the value it holds
+	if v.Kind() == reflect.Interface {
+		v = v.Elem()
+	}
+	if !v.IsValid() {
 		vardict.SetType("nil")
 		vardict.SetMeta("nil")
 		vardict.SetValue(nil)
 		return vardict
 	}
-	if depth > Config.MaxDepth {
+	if depth > w.maxDepth {
 		vardict.SetType("depth")
 		vardict.SetMeta("depth")
 		vardict.SetValue("#DEPTH_EXCEEDED#")
 		return vardict
 	}
-	v := reflect.ValueOf(variable)
-	t := reflect.TypeOf(variable)
+	// Types with a renderer, e.g. sync primitives, are not walked generically
+	if rendered, ok := w.renderValue(v, depth); ok {
+		return rendered
+	}
+	// Contexts are walked through their parent chain instead of their fields
+	if ctx, ok := contextOf(v); ok {
+		return w.walkContext(ctx, depth)
+	}
+	t := v.Type()
 	vardict.SetType(t.Name())
 	kind := v.Kind()
 
@@ -186,36 +254,22 @@ func GetVarDictFromValue(variable interface{}, depth int) VarDict {
 	case reflect.Ptr:
 		vardict.SetMeta("ptr")
 		// No matter what the type is, we need to get VarDict from a pointer
-		ptr := reflect.ValueOf(variable).Pointer()		
+		ptr := v.Pointer()
 		if ptr != 0 {
-			address := fmt.Sprintf("%d", ptr)
-			// Check if the object pointed by ptr has been visited
-			visited := false
-			for _, p := range PointerCache {
-				if p == int64(ptr) {
-					visited = true
-					break
-				}
-			}
-			if !visited {
-				// Put the pointer in for future checking
-				PointerCache = append(PointerCache, int64(ptr))
-				objval := reflect.ValueOf(variable).Elem()
+			objval := v.Elem()
+			// Check if the object pointed by ptr has been visited, and mark it for future checking
+			node := visitKey{ptr: ptr, t: objval.Type()}
+			if node.trackable() && !w.visit(node) {
+				// Make a reference to the node dumped at the first visit
+				vardict.SetValue(newRefVarDict(node))
+			} else {
 				if objval.CanInterface(){			
-					obj := objval.Interface()
-					childVarDict := GetVarDictFromValue(obj, depth+1)
-					childVarDict.SetAddress(address)
+					childVarDict := w.walkValue(objval, depth+1)
+					childVarDict.SetIdentity(ptr, objval.Type())
 					vardict.SetValue(childVarDict)
 				} else{
 					vardict.SetValue("#NULL#")
 				}
-			} else{
-				// Make a special VISITED vardict
-				visitedVarDict := NewVarDict()
-				visitedVarDict.SetAddress(address)
-				visitedVarDict.SetMeta("visited")
-				visitedVarDict.SetValue("#VISITED#")
-				vardict.SetValue(visitedVarDict)
 			}
 		} else {
 			vardict.SetValue("#NULL#")
@@ -224,7 +278,16 @@ func GetVarDictFromValue(variable interface{}, depth int) VarDict {
 		if kind == reflect.Array {
 			vardict.SetMeta("array")
 		} else {
+			// Slices sharing the same backing array and length are the same node
+			node := visitKey{ptr: v.Pointer(), t: t, len: v.Len()}
+			if node.trackable() {
+				if !w.visit(node) {
+					return newRefVarDict(node)
+				}
+				vardict.SetID(node.id())
+			}
 			vardict.SetMeta("slice")
+			w.recordSlice(vardict, v)
 		}
 		// For an array, there is not easy way to covert obj to [len]interface{},
 		// because the len is not a constant. We have to use reflection
@@ -234,16 +297,22 @@ func GetVarDictFromValue(variable interface{}, depth int) VarDict {
 		varDictArray := make([]VarDict, arraylen)
 		for i := 0; i < arraylen; i++ {
 			vi := v.Index(i)
-			obji := vi.Interface()
-			childvardict := GetVarDictFromValue(obji, depth+1)
+			childvardict := w.walkValue(vi, depth+1)
 			if needsPtrForKind(vi.Kind()) && vi.CanAddr() {
-				address := fmt.Sprintf("%d", vi.Addr().Pointer())
-				childvardict.SetAddress(address)
+				childvardict.SetIdentity(vi.Addr().Pointer(), vi.Type())
 			}
 			varDictArray[i] = childvardict
 		}
 		vardict.SetValue(varDictArray)
 	case reflect.Map:
+		// A map reached twice is dumped once
+		node := visitKey{ptr: v.Pointer(), t: t}
+		if node.trackable() {
+			if !w.visit(node) {
+				return newRefVarDict(node)
+			}
+			vardict.SetID(node.id())
+		}
 		vardict.SetMeta("map")
 		// For map, we can convert to map[interface{}]interface{}
 		// But let's try reflect first
@@ -253,20 +322,16 @@ func GetVarDictFromValue(variable interface{}, depth int) VarDict {
 		for i, key := range keys {
 			kv := make(KeyValuePair)
 			// Get key's VarDict
-			keyobj := key.Interface()
-			keyVarDict := GetVarDictFromValue(keyobj, depth+1)
+			keyVarDict := w.walkValue(key, depth+1)
 			if needsPtrForKind(key.Kind()) && key.CanAddr() {
-				address := fmt.Sprintf("%d", key.Addr().Pointer())
-				keyVarDict.SetAddress(address)
+				keyVarDict.SetIdentity(key.Addr().Pointer(), key.Type())
 			}
 			kv.setKey(keyVarDict)
 			// Get Value's VarDict
 			value := v.MapIndex(key)
-			valueobj := value.Interface()
-			valueVarDict := GetVarDictFromValue(valueobj, depth+1)
+			valueVarDict := w.walkValue(value, depth+1)
 			if needsPtrForKind(value.Kind()) && value.CanAddr() {
-				address := fmt.Sprintf("%d", value.Addr().Pointer())
-				valueVarDict.SetAddress(address)
+				valueVarDict.SetIdentity(value.Addr().Pointer(), value.Type())
 			}
 			kv.setValue(valueVarDict)
 			varDictArray[i] = kv
@@ -279,19 +344,20 @@ func GetVarDictFromValue(variable interface{}, depth int) VarDict {
 		numFields := t.NumField()
 		for i := 0; i < numFields; i++ {
 			fieldName := t.Field(i).Name
-			value := v.FieldByName(fieldName)
+			value := v.Field(i)
 			// Ignore all function/interface fields in a struct
 			// if value.Kind() == reflect.Func || value.Kind() == reflect.Interface {
 			// 	continue
 			// }
 			if value.CanInterface() {
-				valueobj := value.Interface()
-				valueVarDict := GetVarDictFromValue(valueobj, depth+1)
+				valueVarDict := w.walkValue(value, depth+1)
 				if needsPtrForKind(value.Kind()) && value.CanAddr() {
-					address := fmt.Sprintf("%d", value.Addr().Pointer())
-					valueVarDict.SetAddress(address)
+					valueVarDict.SetIdentity(value.Addr().Pointer(), value.Type())
 				}
 				varDictDict[fieldName] = valueVarDict
+			} else if _, ok := lookupRenderer(value.Type()); ok && depth < w.maxDepth {
+				// Unexported fields with a renderer (e.g. a guarding mutex) are still shown
+				varDictDict[fieldName] = w.walkValue(accessibleField(v, i), depth+1)
 			} else {
 				varDictDict[fieldName] = "#UNEXPORTED#"
 			}
@@ -303,22 +369,26 @@ func GetVarDictFromValue(variable interface{}, depth int) VarDict {
 	case reflect.String:
 		vardict.SetMeta("string")
 		vardict.SetField("len", v.Len())
-		vardict.SetValue(variable)
+		vardict.SetValue(v.Interface())
 	case reflect.Bool:
 		vardict.SetMeta("bool")
-		vardict.SetValue(variable)
+		vardict.SetValue(v.Interface())
 	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Int:
 		vardict.SetMeta("int")
-		vardict.SetValue(variable)
+		vardict.SetField("kind", kind.String())
+		vardict.SetValue(v.Interface())
 	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uint:
 		vardict.SetMeta("uint")
-		vardict.SetValue(variable)
+		vardict.SetField("kind", kind.String())
+		vardict.SetValue(v.Interface())
 	case reflect.Float32, reflect.Float64:
 		vardict.SetMeta("float")
-		vardict.SetValue(variable)
+		vardict.SetField("kind", kind.String())
+		vardict.SetValue(v.Interface())
 	case reflect.Complex64, reflect.Complex128:
 		vardict.SetMeta("complex")
-		vardict.SetValue(fmt.Sprintf("%v", variable))
+		vardict.SetField("kind", kind.String())
+		vardict.SetValue(v.Interface())
 	case reflect.Interface:
 		vardict.SetMeta("interface")
 		vardict.SetValue("#INTERFACE#")
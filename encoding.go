@@ -0,0 +1,263 @@
+package goclear
+
+import "encoding/json"
+import "math"
+import "reflect"
+import "strconv"
+import "strings"
+
+// Numbers are encoded so that they survive JSON and JavaScript unchanged.
+// Every int/uint/float/complex VarDict carries a "kind" field with the
+// exact original kind (int8, uint64, float32...), and its value is encoded as:
+//	int/uint - a JSON number, or a decimal string when beyond +/-2^53
+//	float    - a JSON number, or one of "NaN", "+Inf", "-Inf"
+//	complex  - {real: float, imag: float}, with parts encoded like floats
+// ParseVarDict reverses the encoding, restoring values of the original kind
+
+// The largest integer a float64 (and so JavaScript) represents exactly
+const maxSafeInteger = 1<<53 - 1
+
+// Produce a copy of the VarDict, with all numbers in the encoded form
+func (dict VarDict) encodable() VarDict {
+	encoded := make(VarDict, len(dict))
+	for k, v := range dict {
+		if k != "value" {
+			encoded[k] = v
+		}
+	}
+	encoded["value"] = encodeValue(dict["value"])
+	return encoded
+}
+
+func encodeValue(value interface{}) interface{} {
+	switch value := value.(type) {
+	case VarDict:
+		return value.encodable()
+	case []VarDict:
+		encoded := make([]VarDict, len(value))
+		for i, item := range value {
+			encoded[i] = item.encodable()
+		}
+		return encoded
+	case []KeyValuePair:
+		encoded := make([]KeyValuePair, len(value))
+		for i, pair := range value {
+			kv := make(KeyValuePair)
+			kv.setKey(encodeValue(pair["key"]))
+			kv.setValue(encodeValue(pair["value"]))
+			encoded[i] = kv
+		}
+		return encoded
+	case map[string]interface{}:
+		encoded := make(map[string]interface{})
+		for field, val := range value {
+			encoded[field] = encodeValue(val)
+		}
+		return encoded
+	}
+	return encodeNumber(value)
+}
+
+func encodeFloat(f float64) interface{} {
+	switch {
+	case math.IsNaN(f):
+		return "NaN"
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	}
+	return f
+}
+
+// Numbers of user defined types are encoded as their underlying kind
+func encodeNumber(value interface{}) interface{} {
+	if value == nil {
+		return nil
+	}
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n := v.Int()
+		if n > maxSafeInteger || n < -maxSafeInteger {
+			return strconv.FormatInt(n, 10)
+		}
+		return n
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n := v.Uint()
+		if n > maxSafeInteger {
+			return strconv.FormatUint(n, 10)
+		}
+		return n
+	case reflect.Float32:
+		// Keep the shortest representation of the float32, not of its float64 conversion
+		f := v.Float()
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return encodeFloat(f)
+		}
+		return float32(f)
+	case reflect.Float64:
+		return encodeFloat(v.Float())
+	case reflect.Complex64, reflect.Complex128:
+		c := v.Complex()
+		if v.Kind() == reflect.Complex64 {
+			return map[string]interface{}{
+				"real": encodeNumber(float32(real(c))),
+				"imag": encodeNumber(float32(imag(c))),
+			}
+		}
+		return map[string]interface{}{
+			"real": encodeFloat(real(c)),
+			"imag": encodeFloat(imag(c)),
+		}
+	}
+	return value
+}
+
+// ParseVarDict decodes the JSON produced by VarDict.Dump,
+// restoring numbers to their original kind
+func ParseVarDict(data string) (VarDict, error) {
+	decoder := json.NewDecoder(strings.NewReader(data))
+	decoder.UseNumber()
+	var raw map[string]interface{}
+	if err := decoder.Decode(&raw); err != nil {
+		return nil, err
+	}
+	return decodeVarDict(raw), nil
+}
+
+func decodeVarDict(raw map[string]interface{}) VarDict {
+	vardict := make(VarDict, len(raw))
+	for k, v := range raw {
+		vardict[k] = v
+	}
+	for _, field := range []string{"len", "cap", "offset"} {
+		if n, ok := raw[field].(json.Number); ok {
+			i, _ := n.Int64()
+			vardict[field] = int(i)
+		}
+	}
+	kind, _ := raw["kind"].(string)
+	meta, _ := raw["metatype"].(string)
+	vardict["value"] = decodeValue(meta, kind, raw["value"])
+	return vardict
+}
+
+func decodeValue(meta string, kind string, value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		switch meta {
+		case "complex":
+			return decodeComplex(kind, value)
+		case "ptr", "atomic":
+			return decodeVarDict(value)
+		}
+		// Struct-like values map field names to VarDicts
+		fields := make(map[string]interface{})
+		for field, val := range value {
+			if m, ok := val.(map[string]interface{}); ok {
+				fields[field] = decodeVarDict(m)
+			} else {
+				fields[field] = val
+			}
+		}
+		return fields
+	case []interface{}:
+		if meta == "map" {
+			pairs := make([]KeyValuePair, len(value))
+			for i, item := range value {
+				pair, _ := item.(map[string]interface{})
+				kv := make(KeyValuePair)
+				key, _ := pair["key"].(map[string]interface{})
+				val, _ := pair["value"].(map[string]interface{})
+				kv.setKey(decodeVarDict(key))
+				kv.setValue(decodeVarDict(val))
+				pairs[i] = kv
+			}
+			return pairs
+		}
+		items := make([]VarDict, len(value))
+		for i, item := range value {
+			m, _ := item.(map[string]interface{})
+			items[i] = decodeVarDict(m)
+		}
+		return items
+	case json.Number:
+		return decodeNumber(kind, string(value))
+	case string:
+		if meta == "int" || meta == "uint" || meta == "float" {
+			return decodeNumber(kind, value)
+		}
+	}
+	return value
+}
+
+func decodeFloat(s string, bits int) float64 {
+	switch s {
+	case "NaN":
+		return math.NaN()
+	case "+Inf":
+		return math.Inf(1)
+	case "-Inf":
+		return math.Inf(-1)
+	}
+	f, _ := strconv.ParseFloat(s, bits)
+	return f
+}
+
+func decodeNumber(kind string, s string) interface{} {
+	switch kind {
+	case "int8":
+		n, _ := strconv.ParseInt(s, 10, 8)
+		return int8(n)
+	case "int16":
+		n, _ := strconv.ParseInt(s, 10, 16)
+		return int16(n)
+	case "int32":
+		n, _ := strconv.ParseInt(s, 10, 32)
+		return int32(n)
+	case "int64":
+		n, _ := strconv.ParseInt(s, 10, 64)
+		return n
+	case "int":
+		n, _ := strconv.ParseInt(s, 10, 64)
+		return int(n)
+	case "uint8":
+		n, _ := strconv.ParseUint(s, 10, 8)
+		return uint8(n)
+	case "uint16":
+		n, _ := strconv.ParseUint(s, 10, 16)
+		return uint16(n)
+	case "uint32":
+		n, _ := strconv.ParseUint(s, 10, 32)
+		return uint32(n)
+	case "uint64":
+		n, _ := strconv.ParseUint(s, 10, 64)
+		return n
+	case "uint":
+		n, _ := strconv.ParseUint(s, 10, 64)
+		return uint(n)
+	case "float32":
+		return float32(decodeFloat(s, 32))
+	case "float64":
+		return decodeFloat(s, 64)
+	}
+	// Not a number we produced, keep it as JSON gave it
+	return json.Number(s)
+}
+
+func decodeComplex(kind string, value map[string]interface{}) interface{} {
+	part := func(name string, bits int) float64 {
+		switch p := value[name].(type) {
+		case json.Number:
+			return decodeFloat(string(p), bits)
+		case string:
+			return decodeFloat(p, bits)
+		}
+		return 0
+	}
+	if kind == "complex64" {
+		return complex64(complex(part("real", 32), part("imag", 32)))
+	}
+	return complex(part("real", 64), part("imag", 64))
+}
@@ -0,0 +1,76 @@
+package goclear
+
+import "testing"
+import "math"
+import "strings"
+
+func TestDumpSpecialNumbers(t *testing.T) {
+	type Numbers struct {
+		NaN     float64
+		PosInf  float64
+		NegInf  float32
+		Small   int8
+		Big     uint64
+		MinInt  int64
+		Ratio   float32
+		Complex complex128
+		Tiny    complex64
+	}
+	n := Numbers{
+		NaN:     math.NaN(),
+		PosInf:  math.Inf(1),
+		NegInf:  float32(math.Inf(-1)),
+		Small:   -128,
+		Big:     math.MaxUint64,
+		MinInt:  math.MinInt64,
+		Ratio:   0.1,
+		Complex: complex(1.5, math.Inf(1)),
+		Tiny:    complex(1, -2),
+	}
+	data := GetVarDict("n", n).Dump()
+	if data == "" {
+		t.Fatal("dumping special numbers should not fail")
+	}
+	if !strings.Contains(data, `"18446744073709551615"`) || !strings.Contains(data, `"-9223372036854775808"`) {
+		t.Errorf("64-bit integers should be encoded as strings: %s", data)
+	}
+
+	parsed, err := ParseVarDict(data)
+	if err != nil {
+		t.Fatal("Dump should produce valid JSON:", err)
+	}
+	fields := parsed["value"].(map[string]interface{})
+	value := func(name string) interface{} {
+		return fields[name].(VarDict)["value"]
+	}
+	if f, ok := value("NaN").(float64); !ok || !math.IsNaN(f) {
+		t.Errorf("expected NaN, got %#v", value("NaN"))
+	}
+	if value("PosInf") != math.Inf(1) || value("NegInf") != float32(math.Inf(-1)) {
+		t.Errorf("unexpected infinities %#v %#v", value("PosInf"), value("NegInf"))
+	}
+	expected := map[string]interface{}{
+		"Small":   int8(-128),
+		"Big":     uint64(math.MaxUint64),
+		"MinInt":  int64(math.MinInt64),
+		"Ratio":   float32(0.1),
+		"Complex": complex(1.5, math.Inf(1)),
+		"Tiny":    complex64(complex(1, -2)),
+	}
+	for name, want := range expected {
+		if got := value(name); got != want {
+			t.Errorf("%s: expected %#v, got %#v", name, want, got)
+		}
+	}
+	if fields["Small"].(VarDict)["kind"] != "int8" {
+		t.Errorf("the exact kind should be kept: %v", fields["Small"])
+	}
+}
+
+func TestCompareNaN(t *testing.T) {
+	vd1 := GetVarDict("f", math.NaN())
+	vd2 := GetVarDict("f", math.NaN())
+	if !vd2.Compare(vd1) {
+		t.Error("NaN should compare unchanged with NaN")
+	}
+}
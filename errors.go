@@ -0,0 +1,61 @@
+package goclear
+
+import "errors"
+import "fmt"
+
+// The kinds of errors of the recording pipeline, to test with errors.Is.
+// ErrNotStarted, ErrAlreadyStarted and ErrClosed are in lifecycle.go
+var (
+	// A record was dropped by the Backpressure policy
+	ErrQueueFull = errors.New("goclear: queue full")
+	// A VarDict could not be encoded to JSON
+	ErrEncode = errors.New("goclear: encoding failed")
+	// The sink failed to write records
+	ErrSink = errors.New("goclear: sink failed")
+)
+
+// A RecordError tells which records an error concerns, and whether they are lost.
+// errors.Is(err, ErrSink) tells its kind, errors.Unwrap gives its cause
+type RecordError struct {
+	Kind error
+	// The name of the variable, empty for a batch of several variables
+	Name    string
+	Records int
+	// Whether the records will never reach the sink; the sink errors of records
+	// kept in the spool to be retried are not lost
+	Lost  bool
+	Cause error
+}
+
+func (e *RecordError) Error() string {
+	msg := e.Kind.Error()
+	if e.Name != "" {
+		msg += fmt.Sprintf(" for %s", e.Name)
+	}
+	if e.Records > 1 {
+		msg += fmt.Sprintf(" (%d records)", e.Records)
+	}
+	if e.Lost {
+		msg += ", records lost"
+	}
+	if e.Cause != nil {
+		msg += ": " + e.Cause.Error()
+	}
+	return msg
+}
+
+func (e *RecordError) Is(target error) bool {
+	return target == e.Kind
+}
+
+func (e *RecordError) Unwrap() error {
+	return e.Cause
+}
+
+// Report an error that happened away from the caller of DumpVar, to Configuration.OnError
+func (r *Recorder) reportError(err *RecordError) {
+	r.metrics.failed(err)
+	if r.config.OnError != nil {
+		r.config.OnError(err)
+	}
+}
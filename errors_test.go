@@ -0,0 +1,76 @@
+package goclear
+
+import "context"
+import "errors"
+import "testing"
+
+// An OnError callback collecting the errors
+func collectErrors() (func(err error), chan error) {
+	errs := make(chan error, 100)
+	return func(err error) {
+		errs <- err
+	}, errs
+}
+
+func TestQueueFullError(t *testing.T) {
+	sink := &gatedSink{MemorySink: NewMemorySink(), gate: make(chan struct{}), entered: make(chan struct{}, 1)}
+	r, _ := NewRecorder(Configuration{MaxDepth: 5, Sink: sink, SpoolDir: t.TempDir(), QueueSize: 1, BatchSize: 1})
+	defer r.Close(context.Background())
+	defer close(sink.gate)
+	r.DumpVar("x", 0)
+	<-sink.entered
+	if err := r.DumpVar("x", 1); err != nil {
+		t.Fatalf("expected room for one record: %v", err)
+	}
+	err := r.DumpVar("x", 2)
+	var recordErr *RecordError
+	if !errors.Is(err, ErrQueueFull) || !errors.As(err, &recordErr) || recordErr.Name != "x" || !recordErr.Lost {
+		t.Errorf("expected a lost record of x for a full queue, got %v", err)
+	}
+}
+
+func TestDropOldestReportsError(t *testing.T) {
+	onError, errs := collectErrors()
+	sink := &gatedSink{MemorySink: NewMemorySink(), gate: make(chan struct{}), entered: make(chan struct{}, 1)}
+	r, _ := NewRecorder(Configuration{MaxDepth: 5, Sink: sink, SpoolDir: t.TempDir(), QueueSize: 1, BatchSize: 1,
+		Backpressure: BackpressureDropOldest, OnError: onError})
+	defer r.Close(context.Background())
+	defer close(sink.gate)
+	r.DumpVar("x", 0)
+	<-sink.entered
+	r.DumpVar("x", 1)
+	// The record of another call is dropped, the caller is not told
+	if err := r.DumpVar("y", 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; !errors.Is(err, ErrQueueFull) || err.(*RecordError).Name != "x" {
+		t.Errorf("expected the record of x reported lost, got %v", err)
+	}
+}
+
+func TestEncodeError(t *testing.T) {
+	r, _ := newTestRecorder(t)
+	defer r.Close(context.Background())
+	vardict := VarDict{"name": "c", "metatype": "chan", "value": make(chan int)}
+	if err := r.PostRecord(&vardict); !errors.Is(err, ErrEncode) {
+		t.Errorf("expected ErrEncode, got %v", err)
+	}
+	if r.Dropped()["c"] != 1 {
+		t.Errorf("expected the record counted as dropped: %v", r.Dropped())
+	}
+}
+
+func TestSinkErrorReported(t *testing.T) {
+	onError, errs := collectErrors()
+	sink := &flakySink{MemorySink: NewMemorySink(), down: 1}
+	r, _ := NewRecorder(Configuration{MaxDepth: 5, Sink: sink, SpoolDir: t.TempDir(), OnError: onError})
+	defer r.Close(context.Background())
+	if err := r.DumpVar("x", 1); err != nil {
+		t.Fatalf("the sink fails after DumpVar returned: %v", err)
+	}
+	err := <-errs
+	var recordErr *RecordError
+	if !errors.As(err, &recordErr) || recordErr.Kind != ErrSink || recordErr.Lost || errors.Unwrap(err) == nil {
+		t.Errorf("expected a sink error for a spooled record, got %v", err)
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package goclear
+
+import "os"
+
+// Files are not locked on these systems: a store must not be opened by two writers
+func lockFile(file *os.File) error {
+	return nil
+}
@@ -0,0 +1,16 @@
+//go:build unix
+
+package goclear
+
+import "errors"
+import "os"
+import "syscall"
+
+// Take the exclusive lock of a file without waiting, released when the file is closed
+func lockFile(file *os.File) error {
+	err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return ErrLocked
+	}
+	return err
+}
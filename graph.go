@@ -0,0 +1,104 @@
+package goclear
+
+import "fmt"
+import "reflect"
+
+// Every addressable node of a dump gets an "id" made of its address and type.
+// The same object dumped again, in the same or a later dump, gets the same id,
+// so it can be followed over time.
+// When a node (pointer target, map or slice) is reached again, it is not dumped twice:
+//	{
+//		metatype: "ref",
+//		address: "address of the node",
+//		$ref: "id of the node, as dumped at the first visit"
+//	}
+// Nodes and Resolve rebuild the object graph from such references
+
+func nodeID(ptr uintptr, t reflect.Type) string {
+	return fmt.Sprintf("%x:%s", ptr, t.String())
+}
+
+// The key of a node visited during a dump.
+// A struct and its first field share an address, the type tells them apart.
+// Slices are identified by their backing array, and their length
+type visitKey struct {
+	ptr uintptr
+	t   reflect.Type
+	len int
+}
+
+// Zero sized values may all share one address, and empty slices hold nothing
+func (key visitKey) trackable() bool {
+	if key.ptr == 0 || key.t.Size() == 0 {
+		return false
+	}
+	if key.t.Kind() == reflect.Slice {
+		return key.len > 0 && key.t.Elem().Size() > 0
+	}
+	return true
+}
+
+func (key visitKey) id() string {
+	if key.t.Kind() == reflect.Slice {
+		return fmt.Sprintf("%s/%d", nodeID(key.ptr, key.t), key.len)
+	}
+	return nodeID(key.ptr, key.t)
+}
+
+func newRefVarDict(key visitKey) VarDict {
+	ref := NewVarDict()
+	ref.SetAddress(fmt.Sprintf("%d", key.ptr))
+	ref.SetMeta("ref")
+	ref.SetField("$ref", key.id())
+	return ref
+}
+
+// Nodes indexes all the nodes of a VarDict that have an id
+func (dict VarDict) Nodes() map[string]VarDict {
+	nodes := make(map[string]VarDict)
+	dict.collectNodes(nodes)
+	return nodes
+}
+
+func (dict VarDict) collectNodes(nodes map[string]VarDict) {
+	if id, ok := dict["id"].(string); ok {
+		if _, seen := nodes[id]; !seen {
+			nodes[id] = dict
+		}
+	}
+	switch value := dict["value"].(type) {
+	case VarDict:
+		value.collectNodes(nodes)
+	case []VarDict:
+		for _, item := range value {
+			item.collectNodes(nodes)
+		}
+	case []KeyValuePair:
+		for _, pair := range value {
+			if key, ok := pair["key"].(VarDict); ok {
+				key.collectNodes(nodes)
+			}
+			if val, ok := pair["value"].(VarDict); ok {
+				val.collectNodes(nodes)
+			}
+		}
+	case map[string]interface{}:
+		for _, field := range value {
+			if vd, ok := field.(VarDict); ok {
+				vd.collectNodes(nodes)
+			}
+		}
+	}
+}
+
+// Resolve returns the node a reference points to, or the VarDict itself if it
+// is not a reference. nodes can be indexed from several dumps, to follow
+// references across them
+func (dict VarDict) Resolve(nodes map[string]VarDict) (VarDict, bool) {
+	id, ok := dict["$ref"].(string)
+	if !ok {
+		return dict, true
+	}
+	node, ok := nodes[id]
+	return node, ok
+}
@@ -0,0 +1,103 @@
+package goclear
+
+import "testing"
+
+type graphNode struct {
+	Name string
+	Next *graphNode
+}
+
+func TestRefToFirstVisit(t *testing.T) {
+	a := &graphNode{Name: "a"}
+	b := &graphNode{Name: "b", Next: a}
+	a.Next = b
+
+	vd := GetVarDict("a", a)
+	nodes := vd.Nodes()
+	first := vd["value"].(VarDict)
+	if first["id"] == nil || nodes[first["id"].(string)]["id"] != first["id"] {
+		t.Fatalf("the pointer target should be indexed by its id: %v", first)
+	}
+	// a -> b -> a again, which is a reference to the first node
+	second := first["value"].(map[string]interface{})["Next"].(VarDict)["value"].(VarDict)
+	ref := second["value"].(map[string]interface{})["Next"].(VarDict)["value"].(VarDict)
+	if ref["metatype"] != "ref" || ref["$ref"] != first["id"] {
+		t.Fatalf("expected a reference to %v, got %v", first["id"], ref)
+	}
+	target, ok := ref.Resolve(nodes)
+	if !ok || target["value"].(map[string]interface{})["Name"].(VarDict)["value"] != "a" {
+		t.Errorf("the reference should resolve to node a, got %v", target)
+	}
+
+	// The same object keeps its id in a later dump, and after decoding
+	a.Name = "renamed"
+	parsed, err := ParseVarDict(GetVarDict("a", a).Dump())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed["value"].(VarDict)["id"] != first["id"] {
+		t.Errorf("ids should be stable across dumps: %v != %v", parsed["value"].(VarDict)["id"], first["id"])
+	}
+}
+
+func TestVisitedByAddressAndType(t *testing.T) {
+	type Inner struct {
+		Value int
+	}
+	type Outer struct {
+		First Inner
+		Ptr   *Inner
+	}
+	o := &Outer{First: Inner{1}}
+	// The struct and its first field share an address, but are different nodes
+	o.Ptr = &o.First
+	vd := GetVarDict("o", o)
+	fields := vd["value"].(VarDict)["value"].(map[string]interface{})
+	inner := fields["Ptr"].(VarDict)["value"].(VarDict)
+	if inner["metatype"] != "struct" {
+		t.Errorf("the first field should be dumped, not referenced: %v", inner)
+	}
+}
+
+func TestVisitedMapsAndSlices(t *testing.T) {
+	type Shared struct {
+		M1, M2 map[string]int
+		S1, S2 []int
+		Sub    []int
+	}
+	m := map[string]int{"a": 1}
+	s := []int{1, 2, 3}
+	vd := GetVarDict("shared", Shared{m, m, s, s, s[:2]})
+	fields := vd["value"].(map[string]interface{})
+	m1, m2 := fields["M1"].(VarDict), fields["M2"].(VarDict)
+	if m1["metatype"] != "map" || m2["metatype"] != "ref" || m2["$ref"] != m1["id"] {
+		t.Errorf("the second map should refer to the first: %v %v", m1, m2)
+	}
+	s1, s2 := fields["S1"].(VarDict), fields["S2"].(VarDict)
+	if s1["metatype"] != "slice" || s2["metatype"] != "ref" || s2["$ref"] != s1["id"] {
+		t.Errorf("the second slice should refer to the first: %v %v", s1, s2)
+	}
+	if sub := fields["Sub"].(VarDict); sub["metatype"] != "slice" {
+		t.Errorf("a shorter view of the same array is a different slice: %v", sub)
+	}
+}
+
+func TestConcurrentGetVarDict(t *testing.T) {
+	a := &graphNode{Name: "a"}
+	a.Next = &graphNode{Name: "b", Next: a}
+	done := make(chan bool)
+	for i := 0; i < 8; i++ {
+		go func() {
+			for j := 0; j < 100; j++ {
+				vd := GetVarDict("a", a)
+				if vd["value"].(VarDict)["metatype"] != "struct" {
+					t.Error("a concurrent dump saw another dump's visited nodes")
+				}
+			}
+			done <- true
+		}()
+	}
+	for i := 0; i < 8; i++ {
+		<-done
+	}
+}
@@ -0,0 +1,119 @@
+package goclear
+
+import "context"
+import "errors"
+import "os"
+import "os/signal"
+import "sync"
+import "syscall"
+import "time"
+
+// ErrNotStarted is returned by the package level functions before Start is called
+var ErrNotStarted = errors.New("goclear: not started")
+
+// ErrAlreadyStarted is returned by Start when the default recorder is running
+var ErrAlreadyStarted = errors.New("goclear: already started")
+
+// ErrClosed is returned when recording with a Recorder that was closed
+var ErrClosed = errors.New("goclear: recorder closed")
+
+// The Recorder used by the package level functions, between Start and Stop
+var defaultRecorder *Recorder
+var defaultLock sync.RWMutex
+
+// The signal handler installed by Start, removed by Stop
+type signalHandler struct {
+	signals chan os.Signal
+	stop    chan struct{}
+}
+
+var defaultSignals *signalHandler
+
+func getDefaultRecorder() *Recorder {
+	defaultLock.RLock()
+	defer defaultLock.RUnlock()
+	return defaultRecorder
+}
+
+// Start opens a session with the given configuration, and makes its Recorder
+// the one used by the package level functions (DumpVar, PostRecord...).
+// Nothing is opened, created or started before Start is called
+func Start(config Configuration) (*Recorder, error) {
+	defaultLock.Lock()
+	defer defaultLock.Unlock()
+	if defaultRecorder != nil {
+		return nil, ErrAlreadyStarted
+	}
+	r, err := NewRecorder(config)
+	if err != nil {
+		return nil, err
+	}
+	defaultRecorder = r
+
+	if config.HandleSignals {
+		defaultSignals = &signalHandler{signals: make(chan os.Signal, 1), stop: make(chan struct{})}
+		signal.Notify(defaultSignals.signals, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+		go defaultSignals.handle(r)
+	}
+	return r, nil
+}
+
+// On SIGHUP, SIGINT or SIGTERM, save the pending records and exit with the usual 128+signal status.
+// Only installed when the configuration asks for it, applications usually have their own shutdown,
+// and removed by Stop
+func (h *signalHandler) handle(r *Recorder) {
+	var sig os.Signal
+	select {
+	case sig = <-h.signals:
+		signal.Stop(h.signals)
+	case <-h.stop:
+		return
+	}
+	logInfo("Clearing up before exit", "signal", sig.String())
+	status := 1
+	if number, ok := sig.(syscall.Signal); ok {
+		status = 128 + int(number)
+	}
+	r.SetExitStatus(status)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	r.Close(ctx)
+	cancel()
+	os.Exit(status)
+}
+
+// The depth limit of the package level functions: that of the default recorder once started,
+// so that Start never writes Config while they read it
+func defaultMaxDepth() int {
+	if r := getDefaultRecorder(); r != nil {
+		return r.config.MaxDepth
+	}
+	return Config.MaxDepth
+}
+
+// Stop saves the pending records and closes the default recorder.
+// If ctx is done first, Stop returns its error while the recorder keeps closing
+func Stop(ctx context.Context) error {
+	defaultLock.Lock()
+	r := defaultRecorder
+	defaultRecorder = nil
+	if defaultSignals != nil {
+		// No signal reaches the handler once signal.Stop returns
+		signal.Stop(defaultSignals.signals)
+		close(defaultSignals.stop)
+		defaultSignals = nil
+	}
+	defaultLock.Unlock()
+	if r == nil {
+		return ErrNotStarted
+	}
+	return r.Close(ctx)
+}
+
+// Flush waits until the records posted to the default recorder are saved, or ctx is done
+func Flush(ctx context.Context) error {
+	r := getDefaultRecorder()
+	if r == nil {
+		return ErrNotStarted
+	}
+	return r.Flush(ctx)
+}
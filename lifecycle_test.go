@@ -0,0 +1,80 @@
+package goclear
+
+import "testing"
+import "context"
+import "os"
+import "os/signal"
+import "syscall"
+import "time"
+
+func TestNotStarted(t *testing.T) {
+	if err := DumpVar("x", 1); err != ErrNotStarted {
+		t.Errorf("DumpVar before Start should fail with ErrNotStarted, got %v", err)
+	}
+	// Must not panic or block
+	vardict := GetVarDict("x", 1)
+	PostRecord(&vardict)
+	if err := Stop(context.Background()); err != ErrNotStarted {
+		t.Errorf("Stop before Start should fail with ErrNotStarted, got %v", err)
+	}
+}
+
+func TestStartWithoutDatabase(t *testing.T) {
+	config := Config
+	config.DBPath = "nobody:secret@tcp(127.0.0.1:1)/goclear"
+	config.SpoolDir, config.SpillDir = t.TempDir(), t.TempDir()
+	if _, err := Start(config); err == nil {
+		Stop(context.Background())
+		t.Fatal("Start should report that the database can't be used")
+	}
+	if getDefaultRecorder() != nil {
+		t.Error("a failed Start should not leave a default recorder")
+	}
+}
+
+// Start leaves Config alone, while package level functions read it
+func TestStartKeepsConfig(t *testing.T) {
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 100; i++ {
+			GetVarDict("x", []int{1})
+		}
+		close(done)
+	}()
+	if _, err := Start(Configuration{MaxDepth: 0, Sink: NewMemorySink(), SpoolDir: t.TempDir()}); err != nil {
+		t.Fatal(err)
+	}
+	defer Stop(context.Background())
+	<-done
+	if Config.MaxDepth != 5 || Config.Sink != nil {
+		t.Errorf("expected Config to keep its defaults: %+v", Config)
+	}
+	// The package level functions use the depth limit of the default recorder
+	if vd := GetVarDict("x", []int{1}); vd["value"].([]VarDict)[0]["metatype"] != "depth" {
+		t.Errorf("expected the depth limit of the recorder, got %v", vd)
+	}
+}
+
+// Stop removes the signal handler: a signal after Stop reaches the application, not goclear
+func TestStopRemovesSignalHandler(t *testing.T) {
+	for i := 0; i < 2; i++ {
+		if _, err := Start(Configuration{MaxDepth: 5, Sink: NewMemorySink(), SpoolDir: t.TempDir(), HandleSignals: true}); err != nil {
+			t.Fatal(err)
+		}
+		Stop(context.Background())
+	}
+	received := make(chan os.Signal, 1)
+	signal.Notify(received, syscall.SIGHUP)
+	defer signal.Stop(received)
+	process, _ := os.FindProcess(os.Getpid())
+	if err := process.Signal(syscall.SIGHUP); err != nil {
+		t.Skip("signals can't be sent on this system")
+	}
+	select {
+	case <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the application to receive the signal")
+	}
+	// Had a handler of goclear been left, it would have exited the test binary by now
+	time.Sleep(10 * time.Millisecond)
+}
@@ -0,0 +1,53 @@
+package goclear
+
+import "context"
+import "log/slog"
+import "sync"
+
+// goclear logs what happens inside the recorder (batches written, records dropped,
+// sink failures...) to a log/slog Logger. Nothing is logged until SetLogger is called:
+//	goclear.SetLogger(slog.Default())
+//	goclear.SetLogger(slog.New(myHandler))
+// Per record messages are at the Debug level, failures at Warn or Error
+var logger = slog.New(discardHandler{})
+var loggerLock sync.RWMutex
+
+// SetLogger sends the internal messages of goclear to l, or nowhere if l is nil
+func SetLogger(l *slog.Logger) {
+	if l == nil {
+		l = slog.New(discardHandler{})
+	}
+	loggerLock.Lock()
+	defer loggerLock.Unlock()
+	logger = l
+}
+
+func getLogger() *slog.Logger {
+	loggerLock.RLock()
+	defer loggerLock.RUnlock()
+	return logger
+}
+
+func logDebug(msg string, args ...interface{}) {
+	getLogger().Log(context.Background(), slog.LevelDebug, msg, args...)
+}
+
+func logInfo(msg string, args ...interface{}) {
+	getLogger().Log(context.Background(), slog.LevelInfo, msg, args...)
+}
+
+func logWarn(msg string, args ...interface{}) {
+	getLogger().Log(context.Background(), slog.LevelWarn, msg, args...)
+}
+
+func logError(msg string, args ...interface{}) {
+	getLogger().Log(context.Background(), slog.LevelError, msg, args...)
+}
+
+// A slog.Handler enabled for no level
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h discardHandler) WithGroup(string) slog.Handler           { return h }
@@ -0,0 +1,27 @@
+package goclear
+
+import "bytes"
+import "context"
+import "log/slog"
+import "strings"
+import "testing"
+
+func TestSilentByDefault(t *testing.T) {
+	if getLogger().Enabled(context.Background(), slog.LevelError) {
+		t.Error("goclear should log nothing until SetLogger is called")
+	}
+}
+
+func TestSetLogger(t *testing.T) {
+	var buf bytes.Buffer
+	SetLogger(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	defer SetLogger(nil)
+	r, _ := newTestRecorder(t)
+	r.DumpVar("x", 1)
+	r.DumpVar("x", 1)
+	r.Close(context.Background())
+	output := buf.String()
+	if !strings.Contains(output, "level=DEBUG msg=\"Writing records\"") || !strings.Contains(output, "unchanged=true") {
+		t.Errorf("expected the debug messages of the recorder:\n%s", output)
+	}
+}
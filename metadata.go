@@ -0,0 +1,100 @@
+package goclear
+
+import "os"
+import "runtime"
+import "runtime/debug"
+import "strings"
+
+// SessionMetadata tells which build and invocation produced a session.
+// It is collected when the recorder opens, EndTimestamp and ExitStatus are set when it closes
+type SessionMetadata struct {
+	PID        int      `json:"pid"`
+	PPID       int      `json:"ppid"`
+	Executable string   `json:"executable,omitempty"`
+	Args       []string `json:"args,omitempty"`
+	// Only the variables allowed by Configuration.EnvAllowlist
+	Env       map[string]string `json:"env,omitempty"`
+	GoVersion string            `json:"goVersion"`
+	GOOS      string            `json:"goos"`
+	GOARCH    string            `json:"goarch"`
+	// From debug.ReadBuildInfo, when the program was built with module support
+	Module        string `json:"module,omitempty"`
+	ModuleVersion string `json:"moduleVersion,omitempty"`
+	VCS           string `json:"vcs,omitempty"`
+	VCSRevision   string `json:"vcsRevision,omitempty"`
+	VCSTime       string `json:"vcsTime,omitempty"`
+	VCSModified   bool   `json:"vcsModified,omitempty"`
+	// Configuration.Labels
+	Labels       map[string]string `json:"labels,omitempty"`
+	EndTimestamp int64             `json:"endTimestamp,omitempty"`
+	// Set with SetExitStatus before closing, or by the signal handlers
+	ExitStatus *int `json:"exitStatus,omitempty"`
+}
+
+func collectMetadata(config Configuration) *SessionMetadata {
+	metadata := &SessionMetadata{
+		PID:       os.Getpid(),
+		PPID:      os.Getppid(),
+		Args:      os.Args,
+		Env:       allowedEnv(config.EnvAllowlist),
+		GoVersion: runtime.Version(),
+		GOOS:      runtime.GOOS,
+		GOARCH:    runtime.GOARCH,
+		Labels:    config.Labels,
+	}
+	if executable, err := os.Executable(); err == nil {
+		metadata.Executable = executable
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		metadata.Module = info.Main.Path
+		metadata.ModuleVersion = info.Main.Version
+		for _, setting := range info.Settings {
+			switch setting.Key {
+			case "vcs":
+				metadata.VCS = setting.Value
+			case "vcs.revision":
+				metadata.VCSRevision = setting.Value
+			case "vcs.time":
+				metadata.VCSTime = setting.Value
+			case "vcs.modified":
+				metadata.VCSModified = setting.Value == "true"
+			}
+		}
+	}
+	return metadata
+}
+
+// The environment variables matching the allowlist, names or prefixes ending with *
+func allowedEnv(allowlist []string) map[string]string {
+	if len(allowlist) == 0 {
+		return nil
+	}
+	env := make(map[string]string)
+	for _, entry := range os.Environ() {
+		name, value, _ := strings.Cut(entry, "=")
+		for _, allowed := range allowlist {
+			if name == allowed || strings.HasSuffix(allowed, "*") && strings.HasPrefix(name, strings.TrimSuffix(allowed, "*")) {
+				env[name] = value
+				break
+			}
+		}
+	}
+	return env
+}
+
+// SetExitStatus sets the exit status of the program, stored in the session when the recorder closes
+func (r *Recorder) SetExitStatus(status int) {
+	r.closeLock.Lock()
+	defer r.closeLock.Unlock()
+	r.exitStatus = &status
+}
+
+// SetExitStatus sets the exit status stored in the session of the default recorder
+func SetExitStatus(status int) error {
+	r := getDefaultRecorder()
+	if r == nil {
+		return ErrNotStarted
+	}
+	r.SetExitStatus(status)
+	return nil
+}
@@ -0,0 +1,53 @@
+package goclear
+
+import "context"
+import "os"
+import "runtime"
+import "testing"
+
+func TestSessionMetadata(t *testing.T) {
+	t.Setenv("GOCLEAR_TEST_RUN", "42")
+	t.Setenv("GOCLEAR_TEST_SECRET", "hidden")
+	t.Setenv("GOCLEAR_OTHER", "other")
+	sink := NewMemorySink()
+	r, err := NewRecorder(Configuration{
+		MaxDepth:     5,
+		Sink:         sink,
+		SpoolDir:     t.TempDir(),
+		EnvAllowlist: []string{"GOCLEAR_TEST_RUN", "GOCLEAR_OTH*"},
+		Labels:       map[string]string{"suite": "metadata"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessions, _ := sink.Sessions()
+	metadata := sessions[0].Metadata
+	if metadata == nil {
+		t.Fatal("no metadata stored when the session is opened")
+	}
+	if metadata.PID != os.Getpid() || metadata.GoVersion != runtime.Version() || metadata.GOOS != runtime.GOOS {
+		t.Errorf("wrong process metadata: %+v", metadata)
+	}
+	if metadata.EndTimestamp != 0 || metadata.ExitStatus != nil {
+		t.Errorf("the end of the session should not be known yet: %+v", metadata)
+	}
+
+	r.SetExitStatus(3)
+	if err := r.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	sessions, _ = sink.Sessions()
+	metadata = sessions[0].Metadata
+	if metadata.EndTimestamp == 0 {
+		t.Error("no end timestamp")
+	}
+	if metadata.ExitStatus == nil || *metadata.ExitStatus != 3 {
+		t.Errorf("expected exit status 3, got %v", metadata.ExitStatus)
+	}
+	if metadata.Labels["suite"] != "metadata" {
+		t.Errorf("wrong labels: %v", metadata.Labels)
+	}
+	if len(metadata.Env) != 2 || metadata.Env["GOCLEAR_TEST_RUN"] != "42" || metadata.Env["GOCLEAR_OTHER"] != "other" {
+		t.Errorf("expected only the allowed environment, got %v", metadata.Env)
+	}
+}
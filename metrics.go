@@ -0,0 +1,279 @@
+package goclear
+
+import "expvar"
+import "fmt"
+import "net/http"
+import "sort"
+import "strings"
+import "sync"
+import "time"
+
+// Metrics tells how a Recorder keeps up: what was dumped, written, dropped and how the sink performs.
+// The metrics of the running recorders are published as the expvar "goclear", keyed by
+// "<recorder>/<session>", and served in the Prometheus text format by MetricsHandler,
+// labelled by recorder and session: recorders writing to different sinks may have the same session id.
+// HealthHandler tells whether they keep up. A session stores its final metrics
+type Metrics struct {
+	RecordsDumped  int64 `json:"recordsDumped"`
+	RecordsWritten int64 `json:"recordsWritten"`
+	RecordsDropped int64 `json:"recordsDropped"`
+	EncodedBytes   int64 `json:"encodedBytes"`
+	// Errors by kind: queue_full, encode, sink
+	Errors map[string]int64 `json:"errors,omitempty"`
+	// Records waiting in the queue, and posted but not saved yet
+	QueueDepth int `json:"queueDepth"`
+	Pending    int `json:"pending"`
+	// Successful writes to the sink, with their records and duration
+	Batches        int64   `json:"batches"`
+	BatchRecords   int64   `json:"batchRecords"`
+	SinkSeconds    float64 `json:"sinkSeconds"`
+	SinkMaxSeconds float64 `json:"sinkMaxSeconds"`
+	Variables      map[string]VariableMetrics `json:"variables,omitempty"`
+}
+
+// The metrics of one variable name
+type VariableMetrics struct {
+	Dumped       int64 `json:"dumped"`
+	EncodedBytes int64 `json:"encodedBytes"`
+	Dropped      int64 `json:"dropped"`
+}
+
+// The counters of a Recorder; queue depth and drops are read from the recorder when needed
+type metricsCounter struct {
+	mu        sync.Mutex
+	metrics   Metrics
+	variables map[string]*VariableMetrics
+}
+
+func newMetricsCounter() *metricsCounter {
+	return &metricsCounter{
+		metrics:   Metrics{Errors: make(map[string]int64)},
+		variables: make(map[string]*VariableMetrics),
+	}
+}
+
+func (counter *metricsCounter) variable(name string) *VariableMetrics {
+	v, ok := counter.variables[name]
+	if !ok {
+		v = &VariableMetrics{}
+		counter.variables[name] = v
+	}
+	return v
+}
+
+func (counter *metricsCounter) dumped(name string, bytes int) {
+	counter.mu.Lock()
+	defer counter.mu.Unlock()
+	counter.metrics.RecordsDumped++
+	counter.metrics.EncodedBytes += int64(bytes)
+	v := counter.variable(name)
+	v.Dumped++
+	v.EncodedBytes += int64(bytes)
+}
+
+func (counter *metricsCounter) written(records int, latency time.Duration) {
+	counter.mu.Lock()
+	defer counter.mu.Unlock()
+	counter.metrics.RecordsWritten += int64(records)
+	counter.metrics.Batches++
+	counter.metrics.BatchRecords += int64(records)
+	seconds := latency.Seconds()
+	counter.metrics.SinkSeconds += seconds
+	if seconds > counter.metrics.SinkMaxSeconds {
+		counter.metrics.SinkMaxSeconds = seconds
+	}
+}
+
+func (counter *metricsCounter) failed(err *RecordError) {
+	label := "sink"
+	switch err.Kind {
+	case ErrQueueFull:
+		label = "queue_full"
+	case ErrEncode:
+		label = "encode"
+	}
+	counter.mu.Lock()
+	defer counter.mu.Unlock()
+	counter.metrics.Errors[label]++
+}
+
+// Metrics returns the current metrics of the recorder
+func (r *Recorder) Metrics() Metrics {
+	drops := r.drops.counts()
+	counter := r.metrics
+	counter.mu.Lock()
+	defer counter.mu.Unlock()
+	metrics := counter.metrics
+	metrics.Errors = make(map[string]int64, len(counter.metrics.Errors))
+	for kind, n := range counter.metrics.Errors {
+		metrics.Errors[kind] = n
+	}
+	metrics.Variables = make(map[string]VariableMetrics, len(counter.variables))
+	for name, v := range counter.variables {
+		metrics.Variables[name] = *v
+	}
+	for name, n := range drops {
+		v := metrics.Variables[name]
+		v.Dropped = n
+		metrics.Variables[name] = v
+		metrics.RecordsDropped += n
+	}
+	metrics.QueueDepth = len(r.records)
+	metrics.Pending = r.pending.count()
+	return metrics
+}
+
+// The recorders between NewRecorder and Close, whose metrics are published
+var liveRecorders = make(map[*Recorder]bool)
+var liveRecordersLock sync.Mutex
+var publishOnce sync.Once
+
+// The number of recorders made live so far, each one numbered in turn
+var lastLiveID int64
+
+func addLiveRecorder(r *Recorder) {
+	publishOnce.Do(func() {
+		expvar.Publish("goclear", expvar.Func(func() interface{} {
+			all := make(map[string]Metrics)
+			for _, r := range getLiveRecorders() {
+				all[r.metricsKey()] = r.Metrics()
+			}
+			return all
+		}))
+	})
+	liveRecordersLock.Lock()
+	defer liveRecordersLock.Unlock()
+	lastLiveID++
+	r.liveID = lastLiveID
+	liveRecorders[r] = true
+}
+
+// The key of the recorder in the expvar
+func (r *Recorder) metricsKey() string {
+	return fmt.Sprintf("%d/%d", r.liveID, r.SessionID())
+}
+
+func removeLiveRecorder(r *Recorder) {
+	liveRecordersLock.Lock()
+	defer liveRecordersLock.Unlock()
+	delete(liveRecorders, r)
+}
+
+// The live recorders, in the order they were made live
+func getLiveRecorders() []*Recorder {
+	liveRecordersLock.Lock()
+	defer liveRecordersLock.Unlock()
+	recorders := make([]*Recorder, 0, len(liveRecorders))
+	for r := range liveRecorders {
+		recorders = append(recorders, r)
+	}
+	sort.Slice(recorders, func(i, j int) bool {
+		return recorders[i].liveID < recorders[j].liveID
+	})
+	return recorders
+}
+
+// MetricsHandler serves the metrics of the running recorders in the Prometheus text format,
+// labelled by recorder and session, to be mounted by the application, e.g. on /metrics
+func MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.Write([]byte(prometheusText(getLiveRecorders())))
+	})
+}
+
+func prometheusText(recorders []*Recorder) string {
+	all := make([]Metrics, len(recorders))
+	sessions := make([]string, len(recorders))
+	for i, r := range recorders {
+		all[i] = r.Metrics()
+		sessions[i] = fmt.Sprintf(`recorder="%d",session="%d"`, r.liveID, r.SessionID())
+	}
+	var b strings.Builder
+	family := func(name string, kind string, help string, samples func(i int, m Metrics)) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+		for i, m := range all {
+			samples(i, m)
+		}
+	}
+	sample := func(name string, labels string, value interface{}) {
+		fmt.Fprintf(&b, "%s{%s} %v\n", name, labels, value)
+	}
+	perVariable := func(name string, help string, value func(v VariableMetrics) int64) {
+		family(name, "counter", help, func(i int, m Metrics) {
+			for _, variable := range sortedKeys(m.Variables) {
+				sample(name, fmt.Sprintf(`%s,name=%q`, sessions[i], variable), value(m.Variables[variable]))
+			}
+		})
+	}
+	perVariable("goclear_records_dumped_total", "Records posted, by variable.", func(v VariableMetrics) int64 { return v.Dumped })
+	perVariable("goclear_encoded_bytes_total", "Bytes of encoded records, by variable.", func(v VariableMetrics) int64 { return v.EncodedBytes })
+	perVariable("goclear_records_dropped_total", "Records dropped, by variable.", func(v VariableMetrics) int64 { return v.Dropped })
+	family("goclear_records_written_total", "counter", "Records written to the sink.", func(i int, m Metrics) {
+		sample("goclear_records_written_total", sessions[i], m.RecordsWritten)
+	})
+	family("goclear_errors_total", "counter", "Errors, by kind.", func(i int, m Metrics) {
+		for _, kind := range []string{"queue_full", "encode", "sink"} {
+			sample("goclear_errors_total", fmt.Sprintf(`%s,kind="%s"`, sessions[i], kind), m.Errors[kind])
+		}
+	})
+	family("goclear_queue_depth", "gauge", "Records waiting in the queue.", func(i int, m Metrics) {
+		sample("goclear_queue_depth", sessions[i], m.QueueDepth)
+	})
+	family("goclear_pending_records", "gauge", "Records posted and not saved yet.", func(i int, m Metrics) {
+		sample("goclear_pending_records", sessions[i], m.Pending)
+	})
+	family("goclear_batch_size", "summary", "Records per write to the sink.", func(i int, m Metrics) {
+		sample("goclear_batch_size_sum", sessions[i], m.BatchRecords)
+		sample("goclear_batch_size_count", sessions[i], m.Batches)
+	})
+	family("goclear_sink_latency_seconds", "summary", "Duration of the writes to the sink.", func(i int, m Metrics) {
+		sample("goclear_sink_latency_seconds_sum", sessions[i], m.SinkSeconds)
+		sample("goclear_sink_latency_seconds_count", sessions[i], m.Batches)
+	})
+	family("goclear_sink_latency_seconds_max", "gauge", "Longest write to the sink.", func(i int, m Metrics) {
+		sample("goclear_sink_latency_seconds_max", sessions[i], m.SinkMaxSeconds)
+	})
+	return b.String()
+}
+
+// HealthHandler answers 200 while the running recorders keep up, and 503 while one of them
+// spools records its sink failed to write or has a full queue, with the reasons in the body.
+// To be mounted by the application, e.g. on /healthz
+func HealthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		problems := make([]string, 0)
+		for _, r := range getLiveRecorders() {
+			if problem := r.health(); problem != "" {
+				problems = append(problems, fmt.Sprintf("recorder %s: %s", r.metricsKey(), problem))
+			}
+		}
+		if len(problems) > 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(strings.Join(problems, "\n") + "\n"))
+			return
+		}
+		w.Write([]byte("ok\n"))
+	})
+}
+
+// Why the recorder does not keep up, empty if it does
+func (r *Recorder) health() string {
+	if r.spooler.busy() {
+		return "records are spooled while the sink fails"
+	}
+	if len(r.records) >= cap(r.records) {
+		return "the queue is full"
+	}
+	return ""
+}
+
+func sortedKeys(variables map[string]VariableMetrics) []string {
+	names := make([]string, 0, len(variables))
+	for name := range variables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
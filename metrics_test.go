@@ -0,0 +1,102 @@
+package goclear
+
+import "context"
+import "expvar"
+import "fmt"
+import "net/http"
+import "net/http/httptest"
+import "strings"
+import "sync/atomic"
+import "testing"
+import "time"
+
+func TestMetrics(t *testing.T) {
+	r, sink := newTestRecorder(t)
+	for i := 0; i < 3; i++ {
+		r.DumpVar("x", i)
+	}
+	r.DumpVar("y", "y")
+	r.Flush(context.Background())
+
+	m := r.Metrics()
+	if m.RecordsDumped != 4 || m.RecordsWritten != 4 || m.Batches == 0 || m.Pending != 0 {
+		t.Errorf("unexpected metrics: %+v", m)
+	}
+	if m.Variables["x"].Dumped != 3 || m.Variables["y"].EncodedBytes == 0 {
+		t.Errorf("unexpected metrics by variable: %+v", m.Variables)
+	}
+	session := fmt.Sprintf(`recorder="%d",session="%d"`, r.liveID, r.SessionID())
+	if published := expvar.Get("goclear").String(); !strings.Contains(published, fmt.Sprintf(`"%s":`, r.metricsKey())) {
+		t.Errorf("expected the recorder in the expvar: %s", published)
+	}
+
+	response := httptest.NewRecorder()
+	MetricsHandler().ServeHTTP(response, httptest.NewRequest("GET", "/metrics", nil))
+	text := response.Body.String()
+	for _, line := range []string{
+		"# TYPE goclear_records_dumped_total counter",
+		fmt.Sprintf(`goclear_records_dumped_total{%s,name="x"} 3`, session),
+		fmt.Sprintf(`goclear_records_written_total{%s} 4`, session),
+		fmt.Sprintf(`goclear_errors_total{%s,kind="queue_full"} 0`, session),
+	} {
+		if !strings.Contains(text, line+"\n") {
+			t.Errorf("expected %q in:\n%s", line, text)
+		}
+	}
+
+	r.Close(context.Background())
+	if strings.Contains(expvar.Get("goclear").String(), fmt.Sprintf(`"%s":`, r.metricsKey())) {
+		t.Error("a closed recorder should not be published")
+	}
+	sessions, _ := sink.Sessions()
+	if sessions[0].Metrics == nil || sessions[0].Metrics.RecordsWritten != 4 {
+		t.Errorf("expected the metrics in the session: %+v", sessions[0].Metrics)
+	}
+}
+
+// Recorders on different sinks start at the same session id, they are still told apart
+func TestMetricsRecordersApart(t *testing.T) {
+	r1, _ := newTestRecorder(t)
+	r2, _ := newTestRecorder(t)
+	defer r1.Close(context.Background())
+	defer r2.Close(context.Background())
+	if r1.SessionID() != r2.SessionID() {
+		t.Fatalf("expected the same session id on two memory sinks")
+	}
+	published := expvar.Get("goclear").String()
+	response := httptest.NewRecorder()
+	MetricsHandler().ServeHTTP(response, httptest.NewRequest("GET", "/metrics", nil))
+	for _, r := range []*Recorder{r1, r2} {
+		if !strings.Contains(published, fmt.Sprintf(`"%s":`, r.metricsKey())) {
+			t.Errorf("expected recorder %s in the expvar: %s", r.metricsKey(), published)
+		}
+		line := fmt.Sprintf(`goclear_records_written_total{recorder="%d",session="%d"}`, r.liveID, r.SessionID())
+		if strings.Count(response.Body.String(), line) != 1 {
+			t.Errorf("expected one sample %s", line)
+		}
+	}
+}
+
+func TestHealthHandler(t *testing.T) {
+	sink := &flakySink{MemorySink: NewMemorySink()}
+	r, err := NewRecorder(Configuration{MaxDepth: 5, Sink: sink, SpoolDir: t.TempDir(),
+		RetryInterval: time.Hour, MaxRetryInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close(context.Background())
+	health := func() int {
+		response := httptest.NewRecorder()
+		HealthHandler().ServeHTTP(response, httptest.NewRequest("GET", "/healthz", nil))
+		return response.Code
+	}
+	if code := health(); code != http.StatusOK {
+		t.Errorf("expected a healthy recorder, got %d", code)
+	}
+	atomic.StoreInt32(&sink.down, 1)
+	r.DumpVar("x", 1)
+	r.Flush(context.Background())
+	if code := health(); code != http.StatusServiceUnavailable {
+		t.Errorf("expected an unhealthy recorder while spooling, got %d", code)
+	}
+}
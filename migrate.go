@@ -0,0 +1,160 @@
+package goclear
+
+import "context"
+import "database/sql"
+import "errors"
+import "fmt"
+import "sort"
+import "sync"
+import "time"
+
+// A Migration moves the schema of a SQL backend from Version-1 to Version.
+// The versions applied to a database are kept in its schema_version table,
+// so a database created by an older goclear is brought up to date when opened
+type Migration struct {
+	Version     int
+	Description string
+	Statements  []string
+}
+
+// The ordered migrations of a SQL backend
+type migrationSet struct {
+	driver string
+	// Inserts (version, description, timestamp), with the placeholders of the driver
+	insertVersion string
+	// Take a lock held by the connection, selecting 1 once taken, and release it,
+	// so that processes opening the database at once migrate it one after the other
+	lock   string
+	unlock string
+	// Tell whether the error of a statement means it was already applied by a migration
+	// that failed halfway. Nil for backends whose migrations are rolled back as a whole
+	alreadyApplied func(err error) bool
+	migrations     []Migration
+}
+
+var migrationSets = make(map[string]*migrationSet)
+var migrationSetsLock sync.RWMutex
+
+func registerMigrations(backend string, set *migrationSet) {
+	migrationSetsLock.Lock()
+	defer migrationSetsLock.Unlock()
+	migrationSets[backend] = set
+}
+
+func getMigrationSet(backend string) (*migrationSet, error) {
+	migrationSetsLock.RLock()
+	defer migrationSetsLock.RUnlock()
+	set, ok := migrationSets[backend]
+	if !ok {
+		return nil, fmt.Errorf("goclear: backend %q has no schema to migrate", backend)
+	}
+	return set, nil
+}
+
+// A database or one of its connections
+type sqlExecer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// The version of the schema of a database, 0 if it has none
+func schemaVersion(ctx context.Context, db sqlExecer) (int, error) {
+	createStmt := "create table if not exists schema_version (version INTEGER PRIMARY KEY, description TEXT, timestamp BIGINT)"
+	if _, err := db.ExecContext(ctx, createStmt); err != nil {
+		return 0, err
+	}
+	var version int
+	err := db.QueryRowContext(ctx, "select coalesce(max(version), 0) from schema_version").Scan(&version)
+	return version, err
+}
+
+// Apply the migrations above the version of the database, holding the migration lock.
+// Each migration runs in a transaction, but MySQL commits every DDL statement on its own:
+// a migration failing halfway is applied again from its first statement, skipping those
+// that alreadyApplied tells were done. Return the migrations applied
+func (set *migrationSet) migrate(db *sql.DB) ([]Migration, error) {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	var locked sql.NullInt64
+	if err := conn.QueryRowContext(ctx, set.lock).Scan(&locked); err != nil {
+		return nil, err
+	}
+	if locked.Int64 != 1 {
+		return nil, errors.New("goclear: timed out waiting for another process migrating the database")
+	}
+	defer conn.ExecContext(ctx, set.unlock)
+	// Read once locked, another process may have migrated the database meanwhile
+	version, err := schemaVersion(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+	applied := make([]Migration, 0)
+	for _, migration := range set.migrations {
+		if migration.Version <= version {
+			continue
+		}
+		if err := set.apply(ctx, conn, migration); err != nil {
+			return applied, fmt.Errorf("goclear: migration %d (%s): %v", migration.Version, migration.Description, err)
+		}
+		applied = append(applied, migration)
+	}
+	return applied, nil
+}
+
+func (set *migrationSet) apply(ctx context.Context, conn *sql.Conn, migration Migration) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	for _, stmt := range migration.Statements {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			if set.alreadyApplied != nil && set.alreadyApplied(err) {
+				logInfo("Statement of the migration already applied", "version", migration.Version, "sql", stmt)
+				continue
+			}
+			tx.Rollback()
+			return err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, set.insertVersion, migration.Version, migration.Description, time.Now().Unix()); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Migrate brings the database of a SQL backend to the latest schema,
+// and returns the migrations applied with the version reached
+func Migrate(backend string, path string) ([]Migration, int, error) {
+	set, err := getMigrationSet(backend)
+	if err != nil {
+		return nil, 0, err
+	}
+	db, err := sql.Open(set.driver, path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer db.Close()
+	applied, err := set.migrate(db)
+	if err != nil {
+		return applied, 0, err
+	}
+	version, err := schemaVersion(context.Background(), db)
+	return applied, version, err
+}
+
+// MigrationBackends lists the backends with a schema to migrate
+func MigrationBackends() []string {
+	migrationSetsLock.RLock()
+	defer migrationSetsLock.RUnlock()
+	names := make([]string, 0, len(migrationSets))
+	for name := range migrationSets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,159 @@
+package goclear
+
+import "context"
+import "database/sql"
+import "database/sql/driver"
+import "errors"
+import "io"
+import "strings"
+import "sync"
+import "testing"
+import "github.com/go-sql-driver/mysql"
+
+// Versions must follow each other from 1, a gap would be skipped forever
+func TestMigrationVersions(t *testing.T) {
+	for _, backend := range MigrationBackends() {
+		set, _ := getMigrationSet(backend)
+		for i, migration := range set.migrations {
+			if migration.Version != i+1 {
+				t.Errorf("%s: migration %d has version %d", backend, i+1, migration.Version)
+			}
+			if len(migration.Statements) == 0 || migration.Description == "" {
+				t.Errorf("%s: migration %d is empty", backend, migration.Version)
+			}
+		}
+	}
+}
+
+func TestMigrateUnknownBackend(t *testing.T) {
+	if _, _, err := Migrate("memory", ""); err == nil {
+		t.Error("expected an error for a backend without schema")
+	}
+}
+
+// A database/sql driver standing for a MySQL server, whose DDL statements
+// commit on their own: those already applied fail like they would on the server
+type fakeMySQL struct {
+	mu         sync.Mutex
+	version    int
+	applied    map[string]bool
+	statements []string
+}
+
+var fakeMySQLs sync.Map
+
+type fakeMySQLDriver struct{}
+
+func (fakeMySQLDriver) Open(name string) (driver.Conn, error) {
+	db, _ := fakeMySQLs.Load(name)
+	return &fakeMySQLConn{db.(*fakeMySQL)}, nil
+}
+
+type fakeMySQLConn struct {
+	db *fakeMySQL
+}
+
+func (conn *fakeMySQLConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("not supported")
+}
+
+func (conn *fakeMySQLConn) Close() error {
+	return nil
+}
+
+func (conn *fakeMySQLConn) Begin() (driver.Tx, error) {
+	return conn, nil
+}
+
+func (conn *fakeMySQLConn) Commit() error {
+	return nil
+}
+
+func (conn *fakeMySQLConn) Rollback() error {
+	return nil
+}
+
+func (conn *fakeMySQLConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	db := conn.db
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.statements = append(db.statements, query)
+	switch {
+	case strings.HasPrefix(query, "insert into schema_version"):
+		db.version = int(args[0].Value.(int64))
+	case strings.HasPrefix(query, "alter table") || strings.HasPrefix(query, "create index"):
+		if db.applied[query] {
+			return nil, &mysql.MySQLError{Number: 1060, Message: "Duplicate column name"}
+		}
+		db.applied[query] = true
+	}
+	return driver.RowsAffected(0), nil
+}
+
+func (conn *fakeMySQLConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	db := conn.db
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.statements = append(db.statements, query)
+	if strings.Contains(query, "schema_version") {
+		return &fakeMySQLRow{value: int64(db.version)}, nil
+	}
+	return &fakeMySQLRow{value: int64(1)}, nil
+}
+
+type fakeMySQLRow struct {
+	value int64
+	done  bool
+}
+
+func (row *fakeMySQLRow) Columns() []string {
+	return []string{"value"}
+}
+
+func (row *fakeMySQLRow) Close() error {
+	return nil
+}
+
+func (row *fakeMySQLRow) Next(dest []driver.Value) error {
+	if row.done {
+		return io.EOF
+	}
+	row.done = true
+	dest[0] = row.value
+	return nil
+}
+
+func init() {
+	sql.Register("fakemysql", fakeMySQLDriver{})
+}
+
+// A migration whose first statements were committed before it failed is applied again
+func TestMigratePartiallyApplied(t *testing.T) {
+	fake := &fakeMySQL{version: 7, applied: make(map[string]bool)}
+	last := mysqlMigrations.migrations[7]
+	fake.applied[last.Statements[0]] = true
+	fakeMySQLs.Store(t.Name(), fake)
+	db, _ := sql.Open("fakemysql", t.Name())
+	defer db.Close()
+
+	applied, err := mysqlMigrations.migrate(db)
+	if err != nil || len(applied) != 1 || fake.version != 8 {
+		t.Fatalf("expected migration 8 to be applied again: %v %v", applied, err)
+	}
+	if !fake.applied[last.Statements[2]] {
+		t.Error("expected the statements after the committed one to be applied")
+	}
+	if first, end := fake.statements[0], fake.statements[len(fake.statements)-1]; first != mysqlMigrations.lock || end != mysqlMigrations.unlock {
+		t.Errorf("expected the migration to hold the lock: %s ... %s", first, end)
+	}
+
+	// Applied again in full, as when the version failed to be inserted
+	fake.version = 7
+	if _, err := mysqlMigrations.migrate(db); err != nil {
+		t.Fatalf("expected every statement to be tolerated once applied: %v", err)
+	}
+	// Statements failing for another reason still stop the migration
+	if mysqlAlreadyApplied(&mysql.MySQLError{Number: 1146}) || mysqlAlreadyApplied(errors.New("1060")) {
+		t.Error("only the errors of statements already applied should be tolerated")
+	}
+}
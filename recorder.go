@@ -0,0 +1,251 @@
+package goclear
+
+import "context"
+import "io"
+import "os"
+import "sync"
+import "sync/atomic"
+import "time"
+
+// A Recorder dumps variables into its own session, with its own configuration,
+// sink, workers and last values. Several recorders can live in one process.
+// The package level functions (DumpVar, Finish...) use the one created by Start
+type Recorder struct {
+	config  Configuration
+	sink    Sink
+	// Whether the sink was opened by the recorder, and must be closed with it
+	ownsSink bool
+	session  Session
+	// When the session started, on the monotonic clock, and the sequence number of the last record
+	start    time.Time
+	sequence atomic.Int64
+	// Records waiting to be saved by the workers
+	records chan queuedRecord
+	wg      sync.WaitGroup
+	pending *pendingCounter
+	last    *lastValueStore
+	drops   *dropCounter
+	metrics *metricsCounter
+	stacks  *stackTable
+	// With the spill backpressure policy, the records waiting on disk for room in the queue
+	spill     *spill
+	spillDone sync.WaitGroup
+	// The records the sink failed to write, replayed when it works again
+	spooler *spooler
+	// Once closed, records are refused; PostRecord holds the read lock while queueing
+	closeLock  sync.RWMutex
+	closed     bool
+	exitStatus *int
+	// Tells the live recorders apart in the metrics, whose sessions may have the same id
+	liveID int64
+}
+
+// NewRecorder opens the sink, creates a new session and starts the workers
+func NewRecorder(config Configuration) (*Recorder, error) {
+	config = config.withDefaults()
+	r := &Recorder{
+		config:  config,
+		sink:    config.Sink,
+		pending: newPendingCounter(),
+		last:    newLastValueStore(),
+		drops:   newDropCounter(),
+		metrics: newMetricsCounter(),
+		stacks:  newStackTable(),
+	}
+	if r.sink == nil {
+		sink, err := OpenSink(config.Backend, config.DBPath)
+		if err != nil {
+			return nil, err
+		}
+		r.sink = sink
+		r.ownsSink = true
+	}
+
+	// Get the execution environment, including hostname, path and timestamp
+	hostname, err1 := os.Hostname()
+	cwd, err2 := os.Getwd()
+	if err1 != nil || err2 != nil {
+		logWarn("Fail to get environment information", "hostname_error", err1, "cwd_error", err2)
+	}
+	r.start = time.Now()
+	r.session = Session{Timestamp: r.start.Unix(), Hostname: hostname, Path: cwd, Metadata: collectMetadata(config)}
+	if err := r.sink.OpenSession(&r.session); err != nil {
+		r.closeSink()
+		return nil, err
+	}
+
+	// Replay what earlier runs left in the spool before anything else
+	r.spooler = newSpooler(config, &r.session)
+	r.spooler.adoptLeftovers()
+	r.spooler.done.Add(1)
+	go r.replaySpool()
+
+	// Initialize the channel for records to be saved
+	r.records = make(chan queuedRecord, config.QueueSize)
+	if config.Backpressure == BackpressureSpill {
+		spill, err := newSpill(config.SpillDir, &r.session)
+		if err != nil {
+			r.spooler.close()
+			r.sink.CloseSession(&r.session)
+			r.closeSink()
+			return nil, err
+		}
+		r.spill = spill
+		r.spillDone.Add(1)
+		go r.feedSpill()
+	}
+	// Start the workers to listen on the channel
+	r.wg.Add(config.Workers)
+	for i := 0; i < config.Workers; i++ {
+		go r.worker()
+	}
+	addLiveRecorder(r)
+	return r, nil
+}
+
+// SessionID returns the id of the session the recorder writes to
+func (r *Recorder) SessionID() int64 {
+	return r.session.ID
+}
+
+// DumpVar records the value of a variable, or only what changed since it was last recorded,
+// with the location it is called from. Variables of Configuration.StackNames get a stack trace
+func (r *Recorder) DumpVar(name string, object interface{}) error {
+	return r.dumpVar(name, object, r.originOf(name, 1, false))
+}
+
+// DumpVarWithStack is DumpVar, recording the stack trace of the call
+func (r *Recorder) DumpVarWithStack(name string, object interface{}) error {
+	return r.dumpVar(name, object, r.originOf(name, 1, true))
+}
+
+func (r *Recorder) dumpVar(name string, object interface{}, origin recordOrigin) error {
+	// The sequence number and capture time are taken in the order of the diffs,
+	// so that replaying the records by sequence rebuilds the values
+	vardict, based := r.last.diff(name, getVarDict(name, object, r.config.MaxDepth), func() {
+		r.stamp(&origin)
+	})
+	origin.based = based
+	// An unchanged vardict is still recorded under the name of its variable
+	vardict.SetField("name", name)
+	return r.postRecord(&vardict, origin)
+}
+
+// Flush waits until all the records posted so far are saved, or ctx is done.
+// The recorder keeps running
+func (r *Recorder) Flush(ctx context.Context) error {
+	return r.pending.wait(ctx)
+}
+
+// Dropped returns the number of records dropped for each variable name
+func (r *Recorder) Dropped() map[string]int64 {
+	return r.drops.counts()
+}
+
+// Close saves the pending records, stops the workers and closes the session.
+// If ctx is done first, Close returns its error while the recorder keeps closing.
+// Records posted after Close are refused with ErrClosed
+func (r *Recorder) Close(ctx context.Context) error {
+	r.closeLock.Lock()
+	if r.closed {
+		r.closeLock.Unlock()
+		return ErrClosed
+	}
+	r.closed = true
+	r.closeLock.Unlock()
+	done := make(chan error, 1)
+	go func() {
+		done <- r.shutdown()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (r *Recorder) shutdown() error {
+	// The spilled records go to the queue before it is closed
+	if r.spill != nil {
+		r.spill.close()
+		r.spillDone.Wait()
+	}
+	// close the channel
+	close(r.records)
+	// Wait for the goroutine to finish
+	r.wg.Wait()
+	if r.spill != nil {
+		r.spill.remove()
+	}
+	r.spooler.close()
+	removeLiveRecorder(r)
+	r.session.Drops = r.drops.counts()
+	metrics := r.Metrics()
+	r.session.Metrics = &metrics
+	r.session.Metadata.EndTimestamp = time.Now().Unix()
+	r.closeLock.RLock()
+	r.session.Metadata.ExitStatus = r.exitStatus
+	r.closeLock.RUnlock()
+	err := r.sink.CloseSession(&r.session)
+	if closeErr := r.closeSink(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Close the sink if the recorder opened it, and the sink needs closing
+func (r *Recorder) closeSink() error {
+	closer, ok := r.sink.(io.Closer)
+	if !r.ownsSink || !ok {
+		return nil
+	}
+	return closer.Close()
+}
+
+// Count the records posted but not saved yet, so that Flush can wait for them
+type pendingCounter struct {
+	mu sync.Mutex
+	n  int
+	// Closed when n gets back to 0
+	zero chan struct{}
+}
+
+func newPendingCounter() *pendingCounter {
+	return &pendingCounter{}
+}
+
+func (counter *pendingCounter) add(delta int) {
+	counter.mu.Lock()
+	defer counter.mu.Unlock()
+	counter.n += delta
+	if counter.n <= 0 && counter.zero != nil {
+		close(counter.zero)
+		counter.zero = nil
+	}
+}
+
+func (counter *pendingCounter) count() int {
+	counter.mu.Lock()
+	defer counter.mu.Unlock()
+	return counter.n
+}
+
+func (counter *pendingCounter) wait(ctx context.Context) error {
+	counter.mu.Lock()
+	if counter.n <= 0 {
+		counter.mu.Unlock()
+		return nil
+	}
+	if counter.zero == nil {
+		counter.zero = make(chan struct{})
+	}
+	zero := counter.zero
+	counter.mu.Unlock()
+	select {
+	case <-zero:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,261 @@
+package goclear
+
+import "context"
+import "fmt"
+import "sync"
+import "testing"
+import "time"
+
+// A recorder writing to memory, going through the whole pipeline
+func newTestRecorder(t *testing.T) (*Recorder, *MemorySink) {
+	sink := NewMemorySink()
+	r, err := NewRecorder(Configuration{MaxDepth: 5, Sink: sink, SpoolDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r, sink
+}
+
+func TestIndependentRecorders(t *testing.T) {
+	r1, sink1 := newTestRecorder(t)
+	r2, sink2 := newTestRecorder(t)
+	r1.DumpVar("x", 1)
+	r1.DumpVar("x", 1)
+	r2.DumpVar("x", 1)
+	r1.Flush(context.Background())
+	r2.Flush(context.Background())
+
+	records, _ := sink1.Records(r1.SessionID(), 0, 10)
+	if len(records) != 2 {
+		t.Fatalf("expected 2 records in the first recorder, got %d", len(records))
+	}
+	// r2 has never seen x, so it must not be diffed against r1's value
+	records, _ = sink2.Records(r2.SessionID(), 0, 10)
+	if len(records) != 1 {
+		t.Fatalf("expected 1 record in the second recorder, got %d", len(records))
+	}
+	vardict, err := ParseVarDict(records[0].Data)
+	if err != nil || vardict["metatype"] == "unchanged" {
+		t.Errorf("recorders should not share last values: %v %v", vardict, err)
+	}
+	if err := r1.Close(context.Background()); err != nil {
+		t.Error(err)
+	}
+	r2.Close(context.Background())
+}
+
+// A sink taking some time for each write, like a database round trip, and counting batches
+type slowSink struct {
+	*MemorySink
+	latency time.Duration
+	mu      sync.Mutex
+	batches []int
+}
+
+func (sink *slowSink) WriteBatch(records []Record) error {
+	time.Sleep(sink.latency)
+	sink.mu.Lock()
+	sink.batches = append(sink.batches, len(records))
+	sink.mu.Unlock()
+	return sink.MemorySink.WriteBatch(records)
+}
+
+func TestBatching(t *testing.T) {
+	sink := &slowSink{MemorySink: NewMemorySink()}
+	r, err := NewRecorder(Configuration{MaxDepth: 5, Sink: sink, SpoolDir: t.TempDir(), BatchSize: 10, FlushInterval: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close(context.Background())
+	for i := 0; i < 25; i++ {
+		r.DumpVar("i", i)
+	}
+	r.Flush(context.Background())
+	records, _ := sink.Records(r.SessionID(), 0, 100)
+	if len(records) != 25 {
+		t.Fatalf("expected 25 records, got %d", len(records))
+	}
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	for _, size := range sink.batches {
+		if size > 10 {
+			t.Errorf("batch of %d records above the batch size", size)
+		}
+	}
+	if len(sink.batches) >= 25 {
+		t.Errorf("expected records to be written in batches: %v", sink.batches)
+	}
+}
+
+func TestWorkerPool(t *testing.T) {
+	sink := NewMemorySink()
+	r, err := NewRecorder(Configuration{MaxDepth: 5, Sink: sink, SpoolDir: t.TempDir(), Workers: 4, QueueSize: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 500; i++ {
+		r.DumpVar(fmt.Sprint("v", i%7), i)
+	}
+	r.Close(context.Background())
+	records, _ := sink.Records(r.SessionID(), 0, 1000)
+	if len(records) != 500 {
+		t.Errorf("expected 500 records, got %d", len(records))
+	}
+}
+
+// Write to a sink with a 200µs round trip, one record per write or in batches
+func BenchmarkRecorder(b *testing.B) {
+	cases := []struct {
+		name    string
+		workers int
+		batch   int
+	}{
+		{"unbatched", 1, 1},
+		{"batch100", 1, 100},
+		{"batch100x4", 4, 100},
+	}
+	for _, c := range cases {
+		b.Run(c.name, func(b *testing.B) {
+			sink := &slowSink{MemorySink: NewMemorySink(), latency: 200 * time.Microsecond}
+			// Blocking when the queue is full, so that every record is written and timed
+			r, err := NewRecorder(Configuration{MaxDepth: 5, Sink: sink, SpoolDir: b.TempDir(), Workers: c.workers,
+				QueueSize: 1000, BatchSize: c.batch, FlushInterval: time.Millisecond, Backpressure: BackpressureBlock})
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				r.DumpVar("i", i)
+			}
+			r.Close(context.Background())
+			b.StopTimer()
+			dropped := r.Dropped()["i"]
+			b.ReportMetric(float64(dropped)/float64(b.N), "drops/op")
+			if dropped > 0 {
+				b.Fatalf("%d records dropped, the timing does not cover them", dropped)
+			}
+		})
+	}
+}
+
+func TestDumpAfterClose(t *testing.T) {
+	r, sink := newTestRecorder(t)
+	r.DumpVar("x", 1)
+	if err := r.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// Must not panic
+	if err := r.DumpVar("x", 2); err != ErrClosed {
+		t.Errorf("expected ErrClosed after Close, got %v", err)
+	}
+	if err := r.Close(context.Background()); err != ErrClosed {
+		t.Errorf("expected ErrClosed closing twice, got %v", err)
+	}
+	if records, _ := sink.Records(r.SessionID(), 0, 10); len(records) != 1 {
+		t.Errorf("expected only the record posted before Close: %v", records)
+	}
+}
+
+func TestFlushDeadline(t *testing.T) {
+	sink := &gatedSink{MemorySink: NewMemorySink(), gate: make(chan struct{}), entered: make(chan struct{}, 1)}
+	r, _ := NewRecorder(Configuration{MaxDepth: 5, Sink: sink, SpoolDir: t.TempDir()})
+	r.DumpVar("x", 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := r.Flush(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected Flush to give up at the deadline, got %v", err)
+	}
+	// Flush does not close anything
+	if err := r.DumpVar("x", 2); err != nil {
+		t.Errorf("expected the recorder to keep running: %v", err)
+	}
+	close(sink.gate)
+	if err := r.Flush(context.Background()); err != nil {
+		t.Error(err)
+	}
+	if err := r.Close(context.Background()); err != nil {
+		t.Error(err)
+	}
+	if records, _ := sink.Records(r.SessionID(), 0, 10); len(records) != 2 {
+		t.Errorf("expected both records: %v", records)
+	}
+}
+
+// With several workers records are written out of order, the sequence numbers keep the order of the calls
+func TestRecordOrdering(t *testing.T) {
+	sink := NewMemorySink()
+	r, err := NewRecorder(Configuration{MaxDepth: 5, Sink: sink, SpoolDir: t.TempDir(), Workers: 4, BatchSize: 1, Backpressure: BackpressureBlock})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	for i := 0; i < 200; i++ {
+		r.DumpVar(fmt.Sprintf("x%d", i), i)
+	}
+	r.Close(context.Background())
+
+	records, _ := RecordsBySequence(sink, r.SessionID(), 0, 1000)
+	if len(records) != 200 {
+		t.Fatalf("expected 200 records, got %d", len(records))
+	}
+	for i, record := range records {
+		if record.Sequence != int64(i+1) || record.Name != fmt.Sprintf("x%d", i) {
+			t.Fatalf("record %d out of order: sequence %d, name %s", i, record.Sequence, record.Name)
+		}
+		if record.TimestampNano < start.UnixNano() || record.Timestamp != record.TimestampNano/int64(time.Second) {
+			t.Errorf("wrong capture time %d %d", record.Timestamp, record.TimestampNano)
+		}
+		if i > 0 && (record.Offset < records[i-1].Offset || record.TimestampNano < records[i-1].TimestampNano) {
+			t.Errorf("record %d was captured before the previous one", i)
+		}
+	}
+	after, _ := RecordsBySequence(sink, r.SessionID(), 150, 10)
+	if len(after) != 10 || after[0].Sequence != 151 {
+		t.Errorf("expected 10 records from sequence 151, got %d", len(after))
+	}
+}
+
+// Goroutines dumping the same name race for the diff chain: replaying the records
+// by sequence must give each goroutine its own value, unchanged records included
+func TestConcurrentDumpsReplayBySequence(t *testing.T) {
+	sink := NewMemorySink()
+	r, err := NewRecorder(Configuration{MaxDepth: 5, Sink: sink, SpoolDir: t.TempDir(), Workers: 4, BatchSize: 1, Backpressure: BackpressureBlock})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	goroutines := make(map[int64]int)
+	var goroutinesLock sync.Mutex
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			goroutinesLock.Lock()
+			goroutines[goroutineID()] = g
+			goroutinesLock.Unlock()
+			for i := 0; i < 50; i++ {
+				r.DumpVar("shared", g)
+			}
+		}(g)
+	}
+	wg.Wait()
+	r.Close(context.Background())
+
+	records, _ := RecordsBySequence(sink, r.SessionID(), 0, 1000)
+	if len(records) != 400 {
+		t.Fatalf("expected 400 records, got %d", len(records))
+	}
+	var current interface{}
+	for _, record := range records {
+		vardict, err := ParseVarDict(record.Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if vardict["metatype"] != "unchanged" {
+			current = vardict["value"]
+		}
+		if fmt.Sprint(current) != fmt.Sprint(goroutines[record.Goroutine]) {
+			t.Fatalf("record %d replays to %v, goroutine %d dumped %d", record.Sequence, current, record.Goroutine, goroutines[record.Goroutine])
+		}
+	}
+}
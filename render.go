@@ -0,0 +1,75 @@
+package goclear
+
+import "reflect"
+import "sync"
+import "unsafe"
+
+// A renderer generates the VarDict for values of a specific type,
+// in place of the generic walk through the type's fields.
+// The value passed to a renderer is always addressable, so its memory can be
+// read with atomic loads and its unexported fields can be accessed
+type renderer func(w *walker, v reflect.Value, depth int) VarDict
+
+var renderers = make(map[reflect.Type]renderer)
+
+// Some renderers apply to a family of types (e.g. generic ones) rather than a single type
+var rendererMatchers = make([]func(t reflect.Type) renderer, 0)
+
+// Renderers may be registered while other goroutines are dumping
+var renderersLock sync.RWMutex
+
+func registerRenderer(t reflect.Type, r renderer) {
+	renderersLock.Lock()
+	defer renderersLock.Unlock()
+	renderers[t] = r
+}
+
+func registerRendererMatcher(m func(t reflect.Type) renderer) {
+	renderersLock.Lock()
+	defer renderersLock.Unlock()
+	rendererMatchers = append(rendererMatchers, m)
+}
+
+func lookupRenderer(t reflect.Type) (renderer, bool) {
+	renderersLock.RLock()
+	defer renderersLock.RUnlock()
+	if r, ok := renderers[t]; ok {
+		return r, true
+	}
+	for _, m := range rendererMatchers {
+		if r := m(t); r != nil {
+			return r, true
+		}
+	}
+	return nil, false
+}
+
+// Get an addressable version of v, copying it if necessary
+func addressable(v reflect.Value) reflect.Value {
+	if v.CanAddr() {
+		return v
+	}
+	copied := reflect.New(v.Type()).Elem()
+	copied.Set(v)
+	return copied
+}
+
+// Get an addressable field that can be used like an exported one, even if it is not
+func accessibleField(v reflect.Value, i int) reflect.Value {
+	field := addressable(v).Field(i)
+	return reflect.NewAt(field.Type(), unsafe.Pointer(field.UnsafeAddr())).Elem()
+}
+
+// Generate the VarDict with a renderer, if there is one registered for v's type
+func (w *walker) renderValue(v reflect.Value, depth int) (VarDict, bool) {
+	if !v.IsValid() {
+		return nil, false
+	}
+	render, ok := lookupRenderer(v.Type())
+	if !ok {
+		return nil, false
+	}
+	vardict := render(w, addressable(v), depth)
+	vardict.SetType(v.Type().String())
+	return vardict, true
+}
@@ -0,0 +1,274 @@
+package goclear
+
+import "database/sql"
+import "encoding/json"
+import "errors"
+import "fmt"
+import "sort"
+import "strings"
+import "sync"
+
+// A Session is one run of an instrumented program
+type Session struct {
+	ID        int64  `json:"id"`
+	Timestamp int64  `json:"timestamp"`
+	Hostname  string `json:"hostname"`
+	Path      string `json:"path"`
+	// Records dropped for each variable name, and how the recorder kept up, known when the session is closed
+	Drops   map[string]int64 `json:"drops,omitempty"`
+	Metrics *Metrics         `json:"metrics,omitempty"`
+	// Which build and invocation produced the session
+	Metadata *SessionMetadata `json:"metadata,omitempty"`
+}
+
+// A Record is one dumped VarDict, encoded as JSON in Data
+type Record struct {
+	ID        int64 `json:"id"`
+	SessionID int64 `json:"sessionID"`
+	// When DumpVar was called, in seconds and in nanoseconds since the epoch,
+	// and in nanoseconds since the start of the session on the monotonic clock
+	Timestamp     int64 `json:"timestamp"`
+	TimestampNano int64 `json:"timestampNano,omitempty"`
+	Offset        int64 `json:"offset,omitempty"`
+	// The order of the calls to DumpVar in the session, from 1. With several workers
+	// records are written out of order, ids don't follow it
+	Sequence int64  `json:"sequence,omitempty"`
+	Name     string `json:"name"`
+	Data     string `json:"data"`
+	// Where DumpVar was called
+	Caller
+	// The stack trace of the dump in the stack table of the session, 0 without.
+	// Stack holds its frames on the way to the sink only, a Source returns records without them
+	StackID int64        `json:"stackID,omitempty"`
+	Stack   []StackFrame `json:"stack,omitempty"`
+}
+
+// A Sink stores the sessions and records of a Recorder.
+// OpenSession must set the ID of the session, CloseSession stores its final state (Drops, Metrics, Metadata).
+// WriteBatch stores the stacks of the records it has not stored yet in its stack table
+type Sink interface {
+	OpenSession(session *Session) error
+	WriteBatch(records []Record) error
+	CloseSession(session *Session) error
+}
+
+// A Source reads back what a Sink stored, for the web viewer.
+// Records returns at most limit records of a session with an id above after, in order
+type Source interface {
+	Sessions() ([]Session, error)
+	Records(sessionID int64, after int64, limit int) ([]Record, error)
+}
+
+// A StackSource reads back the stack table, for the records with a StackID
+type StackSource interface {
+	Stack(sessionID int64, stackID int64) (Stack, error)
+}
+
+// A SequenceSource returns at most limit records of a session with a Sequence above after,
+// in the order DumpVar was called
+type SequenceSource interface {
+	RecordsBySequence(sessionID int64, after int64, limit int) ([]Record, error)
+}
+
+// RecordsBySequence reads records in the order DumpVar was called from any source,
+// sorting all the records of the session when the source cannot do better
+func RecordsBySequence(source Source, sessionID int64, after int64, limit int) ([]Record, error) {
+	if sequenced, ok := source.(SequenceSource); ok {
+		return sequenced.RecordsBySequence(sessionID, after, limit)
+	}
+	all := make([]Record, 0)
+	for {
+		records, err := source.Records(sessionID, lastRecordID(all), 1000)
+		if err != nil {
+			return nil, err
+		}
+		if len(records) == 0 {
+			break
+		}
+		all = append(all, records...)
+	}
+	return sequenceRecords(all, after, limit), nil
+}
+
+func lastRecordID(records []Record) int64 {
+	if len(records) == 0 {
+		return 0
+	}
+	return records[len(records)-1].ID
+}
+
+// Sort the records of a session by sequence and keep at most limit after a sequence number.
+// Records written before sequence numbers existed are in the order of their ids
+func sequenceRecords(records []Record, after int64, limit int) []Record {
+	sequenced := make([]Record, 0)
+	for _, record := range records {
+		if record.Sequence == 0 {
+			record.Sequence = record.ID
+		}
+		if record.Sequence > after {
+			sequenced = append(sequenced, record)
+		}
+	}
+	sort.Slice(sequenced, func(i, j int) bool {
+		return sequenced[i].Sequence < sequenced[j].Sequence
+	})
+	if len(sequenced) > limit {
+		sequenced = sequenced[:limit]
+	}
+	return sequenced
+}
+
+func errNoStack(sessionID int64, stackID int64) error {
+	return fmt.Errorf("goclear: no stack %d in session %d", stackID, sessionID)
+}
+
+// ErrLocked is returned when opening a store another sink writes to, in this process or another
+var ErrLocked = errors.New("goclear: store is locked by another writer")
+
+// ErrReadOnly is returned when writing to a store opened for reading
+var ErrReadOnly = errors.New("goclear: store is opened for reading")
+
+// A SinkOpener opens a sink from a backend specific path
+type SinkOpener func(path string) (Sink, error)
+
+var sinkOpeners = make(map[string]SinkOpener)
+var sourceOpeners = make(map[string]SourceOpener)
+var sinkOpenersLock sync.RWMutex
+
+// A SourceOpener opens a store for reading only, along with the sink writing to it
+type SourceOpener func(path string) (Source, error)
+
+// RegisterSource gives a backend a way to be read without being opened as a sink,
+// for stores that a single sink may open at a time
+func RegisterSource(backend string, opener SourceOpener) {
+	sinkOpenersLock.Lock()
+	defer sinkOpenersLock.Unlock()
+	sourceOpeners[backend] = opener
+}
+
+// RegisterSink makes a backend available by name, to the Configuration and to the web viewer
+func RegisterSink(backend string, opener SinkOpener) {
+	sinkOpenersLock.Lock()
+	defer sinkOpenersLock.Unlock()
+	sinkOpeners[backend] = opener
+}
+
+// OpenSink opens a sink of a registered backend
+func OpenSink(backend string, path string) (Sink, error) {
+	sinkOpenersLock.RLock()
+	opener, ok := sinkOpeners[backend]
+	sinkOpenersLock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("goclear: unknown backend %q", backend)
+	}
+	return opener(path)
+}
+
+// OpenSource opens a sink of a registered backend for reading
+func OpenSource(backend string, path string) (Source, error) {
+	sinkOpenersLock.RLock()
+	opener, ok := sourceOpeners[backend]
+	sinkOpenersLock.RUnlock()
+	if ok {
+		return opener(path)
+	}
+	sink, err := OpenSink(backend, path)
+	if err != nil {
+		return nil, err
+	}
+	source, ok := sink.(Source)
+	if !ok {
+		return nil, fmt.Errorf("goclear: backend %q can not be read", backend)
+	}
+	return source, nil
+}
+
+// Backends lists the names of the registered backends
+func Backends() []string {
+	sinkOpenersLock.RLock()
+	defer sinkOpenersLock.RUnlock()
+	names := make([]string, 0, len(sinkOpeners))
+	for name := range sinkOpeners {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Rows per insert statement of the SQL sinks, keeping below the placeholder limits of the drivers
+const sqlInsertRows = 1000
+
+// Write records with multi-row inserts, all in one transaction with their new stacks.
+// row returns the values clause of the n-th row, e.g. "(?, ?, ?, ?...)" or "($9, $10, $11, $12...)",
+// insertStack inserts a stack (sessionID, id, frames) unless it exists
+func insertRecords(db *sql.DB, records []Record, row func(n int) string, insertStack string, stacks *storedStacks) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	newStacks := stacks.unstored(records)
+	for _, stack := range newStacks {
+		frames, _ := json.Marshal(stack.Frames)
+		if _, err := tx.Exec(insertStack, stack.SessionID, stack.ID, string(frames)); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	for start := 0; start < len(records); start += sqlInsertRows {
+		end := start + sqlInsertRows
+		if end > len(records) {
+			end = len(records)
+		}
+		values := make([]string, 0, end-start)
+		args := make([]interface{}, 0, recordInsertColumns*(end-start))
+		for i, record := range records[start:end] {
+			values = append(values, row(i))
+			args = append(args, record.SessionID, record.Timestamp, record.Name, record.Data,
+				record.File, record.Line, record.Function, record.Goroutine, record.StackID,
+				record.TimestampNano, record.Offset, record.Sequence)
+		}
+		stmt := "insert into Record (sessionID, timestamp, name, data, file, line, function, goroutine, stackID, timestampNano, offsetNano, seq) values " +
+			strings.Join(values, ", ")
+		if _, err := tx.Exec(stmt, args...); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	stacks.add(newStacks...)
+	return nil
+}
+
+// The values inserted per record
+const recordInsertColumns = 12
+
+// The columns added to Record after its creation, NULL in the rows written before.
+// The records older than sequence numbers are in the order of their ids
+const recordAddedColumns = "coalesce(file, ''), coalesce(line, 0), coalesce(function, ''), coalesce(goroutine, 0), coalesce(stackID, 0), " +
+	"coalesce(timestampNano, 0), coalesce(offsetNano, 0), coalesce(seq, id)"
+
+// Scan a row of Record selected as id, sessionID, timestamp, name, data and recordAddedColumns
+func scanRecord(rows *sql.Rows) (Record, error) {
+	var r Record
+	err := rows.Scan(&r.ID, &r.SessionID, &r.Timestamp, &r.Name, &r.Data, &r.File, &r.Line, &r.Function, &r.Goroutine, &r.StackID,
+		&r.TimestampNano, &r.Offset, &r.Sequence)
+	return r, err
+}
+
+// Encode a field of a session for a SQL column, NULL when empty
+func encodeColumn(value interface{}, empty bool) interface{} {
+	if empty {
+		return nil
+	}
+	data, _ := json.Marshal(value)
+	return string(data)
+}
+
+// Decode a column encoded by encodeColumn into value
+func decodeColumn(data sql.NullString, value interface{}) {
+	if data.Valid {
+		json.Unmarshal([]byte(data.String), value)
+	}
+}
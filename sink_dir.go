@@ -0,0 +1,707 @@
+package goclear
+
+import "bytes"
+import "encoding/binary"
+import "encoding/json"
+import "errors"
+import "fmt"
+import "hash/crc32"
+import "io"
+import "os"
+import "path/filepath"
+import "sort"
+import "sync"
+
+// A DirSink stores sessions in a local directory, without any database:
+//	sessions.log - one frame per session, and another when it is closed with its final state
+//	stacks.log   - one frame per stack of the stack table, written before the records referring to it
+//	<id>.log     - one frame per record of session <id>, the Record as JSON
+//	<id>.idx     - one frame per record: id, timestamp, offset and length in the log, sequence, name
+//	lock         - locked by the DirSink writing to the directory
+// Files are only appended to. Every frame is [length uint32][crc32 uint32][payload],
+// so a frame torn by a crash is detected and dropped when the files are opened again.
+// A log frame missing from the index is indexed again at that time.
+// A batch is written and synced before it counts: a write failing halfway is cut off the files.
+// A single DirSink writes to a directory at a time, holding the lock of its lock file;
+// OpenDirSource reads it meanwhile, without changing anything
+type DirSink struct {
+	mu            sync.Mutex
+	dir           string
+	sessions      *os.File
+	lastSessionID int64
+	stacksLog     *os.File
+	stacksSize    int64
+	stacks        *storedStacks
+	// The session logs being written
+	logs map[int64]*sessionLog
+	// The indexes of the sessions read but not written, kept in memory and completed
+	// with what was appended to their files since they were last read
+	indexes map[int64]*sessionIndex
+	// The lock file held while writing, nil when the store is opened for reading
+	lock *os.File
+}
+
+// The entries of an index file, read up to size
+type sessionIndex struct {
+	entries []indexEntry
+	size    int64
+}
+
+type sessionLog struct {
+	log     *os.File
+	idx     *os.File
+	logSize int64
+	lastID  int64
+	index   sessionIndex
+}
+
+// The index entry of a record
+type indexEntry struct {
+	ID        int64
+	Timestamp int64
+	Offset    int64
+	Length    uint32
+	Sequence  int64
+	Name      string
+}
+
+// Set in the length of the entries followed by a sequence number,
+// index files written before sequence numbers existed have none
+const indexSequenceFlag = 1 << 31
+
+const frameHeaderSize = 8
+
+var errBadFrame = errors.New("goclear: bad frame")
+
+func init() {
+	RegisterSink("dir", func(path string) (Sink, error) {
+		return NewDirSink(path)
+	})
+	RegisterSource("dir", func(path string) (Source, error) {
+		return OpenDirSource(path)
+	})
+}
+
+// NewDirSink opens the store in directory dir for writing, creating it if needed.
+// It fails with ErrLocked while another DirSink writes to dir
+func NewDirSink(dir string) (*DirSink, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	lock, err := os.OpenFile(filepath.Join(dir, "lock"), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(lock); err != nil {
+		lock.Close()
+		return nil, fmt.Errorf("%w: %s", err, dir)
+	}
+	sink := &DirSink{dir: dir, lock: lock, logs: make(map[int64]*sessionLog), indexes: make(map[int64]*sessionIndex),
+		stacks: newStoredStacks()}
+	sessions, size, err := readSessions(dir)
+	if err != nil {
+		lock.Close()
+		return nil, err
+	}
+	for _, session := range sessions {
+		if session.ID > sink.lastSessionID {
+			sink.lastSessionID = session.ID
+		}
+	}
+	sink.sessions, err = openTruncated(filepath.Join(dir, "sessions.log"), size)
+	if err != nil {
+		lock.Close()
+		return nil, err
+	}
+	size, err = readFrames(filepath.Join(dir, "stacks.log"), 0, func(offset int64, payload []byte) error {
+		var stack Stack
+		if err := json.Unmarshal(payload, &stack); err != nil {
+			return err
+		}
+		sink.stacks.add(stack)
+		return nil
+	})
+	if err == nil {
+		sink.stacksLog, err = openTruncated(filepath.Join(dir, "stacks.log"), size)
+		sink.stacksSize = size
+	}
+	if err != nil {
+		sink.sessions.Close()
+		lock.Close()
+		return nil, err
+	}
+	return sink, nil
+}
+
+// OpenDirSource opens the store in directory dir for reading, while a DirSink may write to it.
+// Frames torn or being written are skipped, never cut off the files
+func OpenDirSource(dir string) (*DirSink, error) {
+	if _, err := os.Stat(dir); err != nil {
+		return nil, err
+	}
+	return &DirSink{dir: dir, logs: make(map[int64]*sessionLog), indexes: make(map[int64]*sessionIndex),
+		stacks: newStoredStacks()}, nil
+}
+
+// Open a file for appending, dropping what follows its valid part
+func openTruncated(path string, size int64) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := truncateAt(file, size); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// Cut a file at size and append from there
+func truncateAt(file *os.File, size int64) error {
+	if err := file.Truncate(size); err != nil {
+		return err
+	}
+	_, err := file.Seek(size, io.SeekStart)
+	return err
+}
+
+// Append to a file and sync it, cutting off what was written if either fails
+func appendSynced(file *os.File, size int64, buf []byte) error {
+	if len(buf) == 0 {
+		return nil
+	}
+	_, err := file.Write(buf)
+	if err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		truncateAt(file, size)
+	}
+	return err
+}
+
+func appendFrame(buf []byte, payload []byte) []byte {
+	var header [frameHeaderSize]byte
+	binary.LittleEndian.PutUint32(header[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(header[4:8], crc32.ChecksumIEEE(payload))
+	return append(append(buf, header[:]...), payload...)
+}
+
+func readFrame(r io.Reader) ([]byte, error) {
+	var header [frameHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, errBadFrame
+		}
+		return nil, err
+	}
+	payload := make([]byte, binary.LittleEndian.Uint32(header[0:4]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, errBadFrame
+	}
+	if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(header[4:8]) {
+		return nil, errBadFrame
+	}
+	return payload, nil
+}
+
+// Read the valid frames of a file, starting at offset.
+// Return the size of the valid part; a missing file is empty
+func readFrames(path string, offset int64, visit func(offset int64, payload []byte) error) (int64, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+	reader := io.Reader(file)
+	for {
+		payload, err := readFrame(reader)
+		if err == io.EOF || err == errBadFrame {
+			return offset, nil
+		}
+		if err != nil {
+			return offset, err
+		}
+		if err := visit(offset, payload); err != nil {
+			return offset, err
+		}
+		offset += int64(frameHeaderSize + len(payload))
+	}
+}
+
+func readSessions(dir string) ([]Session, int64, error) {
+	sessions := make([]Session, 0)
+	index := make(map[int64]int)
+	size, err := readFrames(filepath.Join(dir, "sessions.log"), 0, func(offset int64, payload []byte) error {
+		var session Session
+		if err := json.Unmarshal(payload, &session); err != nil {
+			return err
+		}
+		// The last frame of a session is its final state
+		if i, ok := index[session.ID]; ok {
+			sessions[i] = session
+		} else {
+			index[session.ID] = len(sessions)
+			sessions = append(sessions, session)
+		}
+		return nil
+	})
+	return sessions, size, err
+}
+
+func (entry indexEntry) encode() []byte {
+	buf := make([]byte, 36, 36+len(entry.Name))
+	binary.LittleEndian.PutUint64(buf[0:8], uint64(entry.ID))
+	binary.LittleEndian.PutUint64(buf[8:16], uint64(entry.Timestamp))
+	binary.LittleEndian.PutUint64(buf[16:24], uint64(entry.Offset))
+	binary.LittleEndian.PutUint32(buf[24:28], entry.Length|indexSequenceFlag)
+	binary.LittleEndian.PutUint64(buf[28:36], uint64(entry.Sequence))
+	return append(buf, entry.Name...)
+}
+
+func decodeIndexEntry(payload []byte) (indexEntry, error) {
+	if len(payload) < 28 {
+		return indexEntry{}, errBadFrame
+	}
+	entry := indexEntry{
+		ID:        int64(binary.LittleEndian.Uint64(payload[0:8])),
+		Timestamp: int64(binary.LittleEndian.Uint64(payload[8:16])),
+		Offset:    int64(binary.LittleEndian.Uint64(payload[16:24])),
+		Length:    binary.LittleEndian.Uint32(payload[24:28]),
+	}
+	name := payload[28:]
+	if entry.Length&indexSequenceFlag != 0 {
+		if len(payload) < 36 {
+			return indexEntry{}, errBadFrame
+		}
+		entry.Length &^= indexSequenceFlag
+		entry.Sequence = int64(binary.LittleEndian.Uint64(payload[28:36]))
+		name = payload[36:]
+	}
+	entry.Name = string(name)
+	return entry, nil
+}
+
+func (sink *DirSink) logPath(sessionID int64) string {
+	return filepath.Join(sink.dir, fmt.Sprintf("%d.log", sessionID))
+}
+
+func (sink *DirSink) idxPath(sessionID int64) string {
+	return filepath.Join(sink.dir, fmt.Sprintf("%d.idx", sessionID))
+}
+
+// Read what was appended to the index file of a session since index was read,
+// and return the entries of the log frames the index misses, with the size of the valid log
+func (sink *DirSink) readIndex(sessionID int64, index *sessionIndex) (unindexed []indexEntry, logSize int64, err error) {
+	index.size, err = readFrames(sink.idxPath(sessionID), index.size, func(offset int64, payload []byte) error {
+		entry, err := decodeIndexEntry(payload)
+		if err == nil {
+			index.entries = append(index.entries, entry)
+		}
+		return err
+	})
+	if err != nil {
+		return
+	}
+	if n := len(index.entries); n > 0 {
+		last := index.entries[n-1]
+		logSize = last.Offset + int64(last.Length)
+	}
+	unindexed = make([]indexEntry, 0)
+	logSize, err = readFrames(sink.logPath(sessionID), logSize, func(offset int64, payload []byte) error {
+		var record Record
+		if err := json.Unmarshal(payload, &record); err != nil {
+			return err
+		}
+		unindexed = append(unindexed, indexEntry{record.ID, record.Timestamp, offset,
+			uint32(frameHeaderSize + len(payload)), record.Sequence, record.Name})
+		return nil
+	})
+	return
+}
+
+// The index of a session: in memory for the sessions being written,
+// read from where it was left for the others
+func (sink *DirSink) index(sessionID int64) ([]indexEntry, error) {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if log, ok := sink.logs[sessionID]; ok {
+		// Entries are only appended: the slice keeps what is written now
+		return log.index.entries, nil
+	}
+	index, ok := sink.indexes[sessionID]
+	if !ok {
+		index = &sessionIndex{}
+		sink.indexes[sessionID] = index
+	}
+	unindexed, _, err := sink.readIndex(sessionID, index)
+	if err != nil {
+		return nil, err
+	}
+	entries := index.entries[:len(index.entries):len(index.entries)]
+	return append(entries, unindexed...), nil
+}
+
+// Get the log of a session for writing, recovering from an earlier crash if needed
+func (sink *DirSink) sessionLog(sessionID int64) (*sessionLog, error) {
+	if log, ok := sink.logs[sessionID]; ok {
+		return log, nil
+	}
+	log := &sessionLog{}
+	unindexed, logSize, err := sink.readIndex(sessionID, &log.index)
+	if err != nil {
+		return nil, err
+	}
+	log.logSize = logSize
+	if log.idx, err = openTruncated(sink.idxPath(sessionID), log.index.size); err != nil {
+		return nil, err
+	}
+	if log.log, err = openTruncated(sink.logPath(sessionID), logSize); err != nil {
+		log.idx.Close()
+		return nil, err
+	}
+	// Index again the records whose index frames were lost
+	buf := make([]byte, 0)
+	for _, entry := range unindexed {
+		buf = appendFrame(buf, entry.encode())
+	}
+	if err := appendSynced(log.idx, log.index.size, buf); err != nil {
+		log.close()
+		return nil, err
+	}
+	log.index.size += int64(len(buf))
+	log.index.entries = append(log.index.entries, unindexed...)
+	if n := len(log.index.entries); n > 0 {
+		log.lastID = log.index.entries[n-1].ID
+	}
+	delete(sink.indexes, sessionID)
+	sink.logs[sessionID] = log
+	return log, nil
+}
+
+func (log *sessionLog) close() error {
+	err := log.log.Close()
+	if idxErr := log.idx.Close(); err == nil {
+		err = idxErr
+	}
+	return err
+}
+
+func (sink *DirSink) OpenSession(session *Session) error {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if sink.lock == nil {
+		return ErrReadOnly
+	}
+	session.ID = sink.lastSessionID + 1
+	payload, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	if _, err := sink.sessions.Write(appendFrame(nil, payload)); err != nil {
+		return err
+	}
+	sink.lastSessionID = session.ID
+	return nil
+}
+
+// The frames of a batch for the log of a session, applied to it once written
+type sessionBatch struct {
+	log     *sessionLog
+	lastID  int64
+	logBuf  []byte
+	idxBuf  []byte
+	entries []indexEntry
+}
+
+func (sink *DirSink) WriteBatch(records []Record) error {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if sink.lock == nil {
+		return ErrReadOnly
+	}
+	// The stacks are written first, then the log frames before the index frames,
+	// so that nothing points past what is written
+	stacks := sink.stacks.unstored(records)
+	stackBuf := make([]byte, 0)
+	for _, stack := range stacks {
+		payload, err := json.Marshal(stack)
+		if err != nil {
+			return err
+		}
+		stackBuf = appendFrame(stackBuf, payload)
+	}
+	if err := appendSynced(sink.stacksLog, sink.stacksSize, stackBuf); err != nil {
+		return err
+	}
+	sink.stacksSize += int64(len(stackBuf))
+	sink.stacks.add(stacks...)
+	batches := make([]*sessionBatch, 0)
+	bySession := make(map[int64]*sessionBatch)
+	for _, record := range records {
+		batch, ok := bySession[record.SessionID]
+		if !ok {
+			log, err := sink.sessionLog(record.SessionID)
+			if err != nil {
+				return err
+			}
+			batch = &sessionBatch{log: log, lastID: log.lastID}
+			bySession[record.SessionID] = batch
+			batches = append(batches, batch)
+		}
+		record.ID = batch.lastID + 1
+		record.Stack = nil
+		payload, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		frame := appendFrame(nil, payload)
+		entry := indexEntry{record.ID, record.Timestamp, batch.log.logSize + int64(len(batch.logBuf)),
+			uint32(len(frame)), record.Sequence, record.Name}
+		batch.logBuf = append(batch.logBuf, frame...)
+		batch.idxBuf = appendFrame(batch.idxBuf, entry.encode())
+		batch.entries = append(batch.entries, entry)
+		batch.lastID = record.ID
+	}
+	for i, batch := range batches {
+		log := batch.log
+		err := appendSynced(log.log, log.logSize, batch.logBuf)
+		if err == nil {
+			if err = appendSynced(log.idx, log.index.size, batch.idxBuf); err != nil {
+				truncateAt(log.log, log.logSize)
+			}
+		}
+		if err != nil {
+			// Nothing of the batch counts: cut what the sessions before got too
+			for _, written := range batches[:i] {
+				truncateAt(written.log.log, written.log.logSize)
+				truncateAt(written.log.idx, written.log.index.size)
+			}
+			return err
+		}
+	}
+	for _, batch := range batches {
+		log := batch.log
+		log.lastID = batch.lastID
+		log.logSize += int64(len(batch.logBuf))
+		log.index.size += int64(len(batch.idxBuf))
+		log.index.entries = append(log.index.entries, batch.entries...)
+	}
+	return nil
+}
+
+// CloseSession stores the final state of the session, makes its files durable and closes them
+func (sink *DirSink) CloseSession(session *Session) error {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if sink.lock == nil {
+		return ErrReadOnly
+	}
+	payload, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	if _, err := sink.sessions.Write(appendFrame(nil, payload)); err != nil {
+		return err
+	}
+	if err := sink.sessions.Sync(); err != nil {
+		return err
+	}
+	if err := sink.stacksLog.Sync(); err != nil {
+		return err
+	}
+	log, ok := sink.logs[session.ID]
+	if !ok {
+		return nil
+	}
+	delete(sink.logs, session.ID)
+	sink.indexes[session.ID] = &log.index
+	err = log.log.Sync()
+	if idxErr := log.idx.Sync(); err == nil {
+		err = idxErr
+	}
+	if closeErr := log.close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (sink *DirSink) Close() error {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if sink.lock == nil {
+		return nil
+	}
+	err := sink.sessions.Close()
+	if stacksErr := sink.stacksLog.Close(); err == nil {
+		err = stacksErr
+	}
+	for sessionID, log := range sink.logs {
+		if closeErr := log.close(); err == nil {
+			err = closeErr
+		}
+		delete(sink.logs, sessionID)
+	}
+	// The last, once everything is written
+	if lockErr := sink.lock.Close(); err == nil {
+		err = lockErr
+	}
+	sink.lock = nil
+	return err
+}
+
+// Sessions returns the newest session first
+func (sink *DirSink) Sessions() ([]Session, error) {
+	sessions, _, err := readSessions(sink.dir)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].ID > sessions[j].ID
+	})
+	return sessions, nil
+}
+
+// Read the records of the given index entries from the log
+func (sink *DirSink) readRecords(sessionID int64, entries []indexEntry) ([]Record, error) {
+	records := make([]Record, 0, len(entries))
+	if len(entries) == 0 {
+		return records, nil
+	}
+	file, err := os.Open(sink.logPath(sessionID))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	for _, entry := range entries {
+		frame := make([]byte, entry.Length)
+		if _, err := file.ReadAt(frame, entry.Offset); err != nil {
+			return nil, err
+		}
+		payload, err := readFrame(bytes.NewReader(frame))
+		if err != nil {
+			return nil, err
+		}
+		var record Record
+		if err := json.Unmarshal(payload, &record); err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// Find the entries after a record id, the index being ordered by id
+func entriesAfter(entries []indexEntry, after int64) []indexEntry {
+	i := sort.Search(len(entries), func(i int) bool {
+		return entries[i].ID > after
+	})
+	return entries[i:]
+}
+
+func (sink *DirSink) Records(sessionID int64, after int64, limit int) ([]Record, error) {
+	entries, err := sink.index(sessionID)
+	if err != nil {
+		return nil, err
+	}
+	entries = entriesAfter(entries, after)
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+	return sink.readRecords(sessionID, entries)
+}
+
+// Record seeks a single record of a session by its id
+func (sink *DirSink) Record(sessionID int64, recordID int64) (Record, error) {
+	entries, err := sink.index(sessionID)
+	if err != nil {
+		return Record{}, err
+	}
+	entries = entriesAfter(entries, recordID-1)
+	if len(entries) == 0 || entries[0].ID != recordID {
+		return Record{}, fmt.Errorf("goclear: no record %d in session %d", recordID, sessionID)
+	}
+	records, err := sink.readRecords(sessionID, entries[:1])
+	if err != nil {
+		return Record{}, err
+	}
+	return records[0], nil
+}
+
+// RecordsByName returns at most limit records of a variable, with an id above after
+func (sink *DirSink) RecordsByName(sessionID int64, name string, after int64, limit int) ([]Record, error) {
+	entries, err := sink.index(sessionID)
+	if err != nil {
+		return nil, err
+	}
+	named := make([]indexEntry, 0)
+	for _, entry := range entriesAfter(entries, after) {
+		if len(named) == limit {
+			break
+		}
+		if entry.Name == name {
+			named = append(named, entry)
+		}
+	}
+	return sink.readRecords(sessionID, named)
+}
+
+// RecordsBySequence returns at most limit records with a sequence number above after,
+// sorting the index entries of the session before reading only those records
+func (sink *DirSink) RecordsBySequence(sessionID int64, after int64, limit int) ([]Record, error) {
+	entries, err := sink.index(sessionID)
+	if err != nil {
+		return nil, err
+	}
+	sequenced := make([]indexEntry, 0)
+	for _, entry := range entries {
+		if entry.Sequence == 0 {
+			entry.Sequence = entry.ID
+		}
+		if entry.Sequence > after {
+			sequenced = append(sequenced, entry)
+		}
+	}
+	sort.Slice(sequenced, func(i, j int) bool {
+		return sequenced[i].Sequence < sequenced[j].Sequence
+	})
+	if len(sequenced) > limit {
+		sequenced = sequenced[:limit]
+	}
+	records, err := sink.readRecords(sessionID, sequenced)
+	if err != nil {
+		return nil, err
+	}
+	for i := range records {
+		records[i].Sequence = sequenced[i].Sequence
+	}
+	return records, nil
+}
+
+// Stack reads a stack of the stack table
+func (sink *DirSink) Stack(sessionID int64, stackID int64) (Stack, error) {
+	var found *Stack
+	_, err := readFrames(filepath.Join(sink.dir, "stacks.log"), 0, func(offset int64, payload []byte) error {
+		var stack Stack
+		if err := json.Unmarshal(payload, &stack); err != nil {
+			return err
+		}
+		if stack.SessionID == sessionID && stack.ID == stackID {
+			found = &stack
+		}
+		return nil
+	})
+	if err != nil {
+		return Stack{}, err
+	}
+	if found == nil {
+		return Stack{}, errNoStack(sessionID, stackID)
+	}
+	return *found, nil
+}
@@ -0,0 +1,205 @@
+package goclear
+
+import "encoding/binary"
+import "errors"
+import "os"
+import "path/filepath"
+import "testing"
+
+func TestDirSink(t *testing.T) {
+	sink, err := OpenSink("dir", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.(*DirSink).Close()
+	checkSinkRoundTrip(t, sink)
+}
+
+func TestDirSinkSeek(t *testing.T) {
+	sink, err := NewDirSink(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	session := Session{Timestamp: 1}
+	sink.OpenSession(&session)
+	batch := make([]Record, 0)
+	for i, name := range []string{"a", "b", "a", "c", "a"} {
+		batch = append(batch, Record{SessionID: session.ID, Timestamp: int64(i), Name: name, Data: name})
+	}
+	if err := sink.WriteBatch(batch); err != nil {
+		t.Fatal(err)
+	}
+
+	record, err := sink.Record(session.ID, 4)
+	if err != nil || record.Name != "c" || record.Timestamp != 3 {
+		t.Errorf("unexpected record 4: %v %v", record, err)
+	}
+	if _, err := sink.Record(session.ID, 6); err == nil {
+		t.Error("expected an error for a missing record")
+	}
+	named, err := sink.RecordsByName(session.ID, "a", 1, 10)
+	if err != nil || len(named) != 2 || named[0].ID != 3 || named[1].ID != 5 {
+		t.Errorf("unexpected records of a after 1: %v %v", named, err)
+	}
+}
+
+// A torn frame at the end of the log is dropped, and records missing from the index are indexed again
+func TestDirSinkRecovery(t *testing.T) {
+	dir := t.TempDir()
+	sink, err := NewDirSink(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := Session{Timestamp: 1}
+	sink.OpenSession(&session)
+	sink.WriteBatch([]Record{
+		{SessionID: session.ID, Name: "a", Data: "1"},
+		{SessionID: session.ID, Name: "b", Data: "2"},
+	})
+	sink.Close()
+
+	// Lose the last index frame, and tear a frame at the end of the log
+	idxPath := filepath.Join(dir, "1.idx")
+	info, _ := os.Stat(idxPath)
+	os.Truncate(idxPath, info.Size()-3)
+	log, _ := os.OpenFile(filepath.Join(dir, "1.log"), os.O_APPEND|os.O_WRONLY, 0644)
+	log.Write(appendFrame(nil, []byte(`{"Name":"torn"}`))[:10])
+	log.Close()
+
+	reopened, err := NewDirSink(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	records, err := reopened.Records(session.ID, 0, 10)
+	if err != nil || len(records) != 2 || records[1].Name != "b" {
+		t.Fatalf("expected the two complete records: %v %v", records, err)
+	}
+	if err := reopened.WriteBatch([]Record{{SessionID: session.ID, Name: "c", Data: "3"}}); err != nil {
+		t.Fatal(err)
+	}
+	record, err := reopened.Record(session.ID, 3)
+	if err != nil || record.Name != "c" {
+		t.Errorf("expected record 3 appended after recovery: %v %v", record, err)
+	}
+	named, _ := reopened.RecordsByName(session.ID, "b", 0, 10)
+	if len(named) != 1 {
+		t.Errorf("expected b to be indexed again: %v", named)
+	}
+}
+
+// A batch failing to be written is cut off the files, and the next one takes its ids
+func TestDirSinkFailedWrite(t *testing.T) {
+	dir := t.TempDir()
+	sink, err := NewDirSink(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	session := Session{Timestamp: 1}
+	sink.OpenSession(&session)
+	sink.WriteBatch([]Record{{SessionID: session.ID, Name: "a", Data: "1"}})
+
+	// The log frame is written, the index frame fails
+	log := sink.logs[session.ID]
+	log.idx.Close()
+	if err := sink.WriteBatch([]Record{{SessionID: session.ID, Name: "lost", Data: "2"}}); err == nil {
+		t.Fatal("expected the write to fail")
+	}
+	if log.idx, err = os.OpenFile(filepath.Join(dir, "1.idx"), os.O_RDWR|os.O_APPEND, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.WriteBatch([]Record{{SessionID: session.ID, Name: "b", Data: "3"}}); err != nil {
+		t.Fatal(err)
+	}
+	records, err := sink.Records(session.ID, 0, 10)
+	if err != nil || len(records) != 2 || records[1].ID != 2 || records[1].Name != "b" {
+		t.Fatalf("expected the failed batch to leave no trace: %v %v", records, err)
+	}
+
+	// A source reading the directory finds the same records, and those appended later
+	reader, err := OpenDirSource(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	if records, _ := reader.Records(session.ID, 0, 10); len(records) != 2 {
+		t.Errorf("expected 2 records on disk: %v", records)
+	}
+	sink.WriteBatch([]Record{{SessionID: session.ID, Name: "c", Data: "4"}})
+	if record, err := reader.Record(session.ID, 3); err != nil || record.Name != "c" {
+		t.Errorf("expected the appended record to be read: %v %v", record, err)
+	}
+}
+
+// A single sink writes to a directory; sources read it without cutting what is being written
+func TestDirSinkLocked(t *testing.T) {
+	dir := t.TempDir()
+	sink, err := NewDirSink(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewDirSink(dir); !errors.Is(err, ErrLocked) {
+		t.Fatalf("expected a second writer to be refused: %v", err)
+	}
+	session := Session{Timestamp: 1}
+	sink.OpenSession(&session)
+	sink.WriteBatch([]Record{{SessionID: session.ID, Name: "a", Data: "1"}})
+
+	// A frame being appended to the log
+	log, _ := os.OpenFile(filepath.Join(dir, "1.log"), os.O_APPEND|os.O_WRONLY, 0644)
+	log.Write(appendFrame(nil, []byte(`{"Name":"partial"}`))[:10])
+	log.Close()
+	before, _ := os.Stat(filepath.Join(dir, "1.log"))
+	source, err := OpenSource("dir", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessions, _ := source.Sessions()
+	records, _ := source.Records(session.ID, 0, 10)
+	if len(sessions) != 1 || len(records) != 1 {
+		t.Errorf("expected the session and its record: %v %v", sessions, records)
+	}
+	if after, _ := os.Stat(filepath.Join(dir, "1.log")); after.Size() != before.Size() {
+		t.Errorf("expected the source to leave the log alone, %d bytes became %d", before.Size(), after.Size())
+	}
+	if err := source.(*DirSink).OpenSession(&Session{}); err != ErrReadOnly {
+		t.Errorf("expected a source to refuse writes: %v", err)
+	}
+
+	sink.Close()
+	reopened, err := NewDirSink(dir)
+	if err != nil {
+		t.Fatalf("expected the directory to be writable once closed: %v", err)
+	}
+	reopened.Close()
+}
+
+// The index keeps the sequence numbers, entries written without one follow their ids
+func TestDirSinkRecordsBySequence(t *testing.T) {
+	sink, err := NewDirSink(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	session := Session{Timestamp: 1}
+	sink.OpenSession(&session)
+	sink.WriteBatch([]Record{
+		{SessionID: session.ID, Name: "c", Sequence: 3},
+		{SessionID: session.ID, Name: "a", Sequence: 1},
+		{SessionID: session.ID, Name: "b", Sequence: 2},
+	})
+	records, err := sink.RecordsBySequence(session.ID, 1, 10)
+	if err != nil || len(records) != 2 || records[0].Name != "b" || records[1].Name != "c" {
+		t.Errorf("expected b and c, got %v %v", records, err)
+	}
+
+	legacy := indexEntry{ID: 7, Timestamp: 1, Offset: 10, Length: 20, Name: "old"}
+	payload := legacy.encode()
+	binary.LittleEndian.PutUint32(payload[24:28], legacy.Length)
+	payload = append(payload[:28], legacy.Name...)
+	if entry, err := decodeIndexEntry(payload); err != nil || entry != legacy {
+		t.Errorf("expected an entry without sequence number to be read: %v %v", entry, err)
+	}
+}
@@ -0,0 +1,244 @@
+package goclear
+
+import "bufio"
+import "encoding/json"
+import "fmt"
+import "io"
+import "os"
+import "sort"
+import "sync"
+
+// A JSONLSink appends sessions and records to a JSON Lines file, one entry per line:
+//	{"session": {id, timestamp, hostname, path}}
+//	{"record": {id, sessionID, timestamp, name, data...}}
+//	{"stack": {sessionID, id, frames}}
+// A session is appended again when closed, the last entry of a session is its final state.
+// A stack is appended before the first record referring to it.
+// A single JSONLSink writes to a file at a time, holding its lock, since the ids
+// follow the last ones read when it opened; OpenJSONLSource reads it meanwhile
+type JSONLSink struct {
+	mu   sync.Mutex
+	path string
+	// Nil when opened for reading
+	file *os.File
+	// The last ids used in the file, new ones follow them
+	lastSessionID int64
+	lastRecordID  int64
+	stacks        *storedStacks
+}
+
+type jsonlEntry struct {
+	Session *Session `json:"session,omitempty"`
+	Record  *Record  `json:"record,omitempty"`
+	Stack   *Stack   `json:"stack,omitempty"`
+}
+
+func init() {
+	RegisterSink("jsonl", func(path string) (Sink, error) {
+		return NewJSONLSink(path)
+	})
+	RegisterSource("jsonl", func(path string) (Source, error) {
+		return OpenJSONLSource(path)
+	})
+}
+
+// NewJSONLSink opens the file at path for appending, creating it if needed.
+// It fails with ErrLocked while another JSONLSink writes to the file
+func NewJSONLSink(path string) (*JSONLSink, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	// Taken before reading the last ids, so that no other writer uses them
+	if err := lockFile(file); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%w: %s", err, path)
+	}
+	sink := &JSONLSink{path: path, file: file, stacks: newStoredStacks()}
+	err = sink.scan(func(entry jsonlEntry) bool {
+		if entry.Session != nil && entry.Session.ID > sink.lastSessionID {
+			sink.lastSessionID = entry.Session.ID
+		}
+		if entry.Record != nil && entry.Record.ID > sink.lastRecordID {
+			sink.lastRecordID = entry.Record.ID
+		}
+		if entry.Stack != nil {
+			sink.stacks.add(*entry.Stack)
+		}
+		return true
+	})
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return sink, nil
+}
+
+// OpenJSONLSource opens the file at path for reading, while a JSONLSink may write to it.
+// A line being written is skipped
+func OpenJSONLSource(path string) (*JSONLSink, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	return &JSONLSink{path: path, stacks: newStoredStacks()}, nil
+}
+
+// Read the entries of the file in order, until visit returns false
+func (sink *JSONLSink) scan(visit func(entry jsonlEntry) bool) error {
+	file, err := os.Open(sink.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			var entry jsonlEntry
+			// A line cut short by a crash is skipped
+			if json.Unmarshal(line, &entry) == nil && !visit(entry) {
+				return nil
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (sink *JSONLSink) append(entries []jsonlEntry) error {
+	if sink.file == nil {
+		return ErrReadOnly
+	}
+	buf := make([]byte, 0)
+	for _, entry := range entries {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		buf = append(append(buf, line...), '\n')
+	}
+	_, err := sink.file.Write(buf)
+	return err
+}
+
+func (sink *JSONLSink) OpenSession(session *Session) error {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	session.ID = sink.lastSessionID + 1
+	if err := sink.append([]jsonlEntry{{Session: session}}); err != nil {
+		return err
+	}
+	sink.lastSessionID = session.ID
+	return nil
+}
+
+func (sink *JSONLSink) WriteBatch(records []Record) error {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	stacks := sink.stacks.unstored(records)
+	entries := make([]jsonlEntry, 0, len(stacks)+len(records))
+	for i := range stacks {
+		entries = append(entries, jsonlEntry{Stack: &stacks[i]})
+	}
+	for i := range records {
+		record := records[i]
+		record.ID = sink.lastRecordID + int64(i) + 1
+		record.Stack = nil
+		entries = append(entries, jsonlEntry{Record: &record})
+	}
+	if err := sink.append(entries); err != nil {
+		return err
+	}
+	sink.lastRecordID += int64(len(records))
+	sink.stacks.add(stacks...)
+	return nil
+}
+
+func (sink *JSONLSink) CloseSession(session *Session) error {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if err := sink.append([]jsonlEntry{{Session: session}}); err != nil {
+		return err
+	}
+	return sink.file.Sync()
+}
+
+func (sink *JSONLSink) Close() error {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if sink.file == nil {
+		return nil
+	}
+	err := sink.file.Close()
+	sink.file = nil
+	return err
+}
+
+// Sessions returns the newest session first
+func (sink *JSONLSink) Sessions() ([]Session, error) {
+	sessions := make([]Session, 0)
+	index := make(map[int64]int)
+	err := sink.scan(func(entry jsonlEntry) bool {
+		if entry.Session == nil {
+			return true
+		}
+		if i, ok := index[entry.Session.ID]; ok {
+			sessions[i] = *entry.Session
+		} else {
+			index[entry.Session.ID] = len(sessions)
+			sessions = append(sessions, *entry.Session)
+		}
+		return true
+	})
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].ID > sessions[j].ID
+	})
+	return sessions, err
+}
+
+func (sink *JSONLSink) Records(sessionID int64, after int64, limit int) ([]Record, error) {
+	records := make([]Record, 0)
+	err := sink.scan(func(entry jsonlEntry) bool {
+		if entry.Record != nil && entry.Record.SessionID == sessionID && entry.Record.ID > after {
+			records = append(records, *entry.Record)
+		}
+		return len(records) < limit
+	})
+	return records, err
+}
+
+// RecordsBySequence reads the records of the session in a single pass, and sorts them
+func (sink *JSONLSink) RecordsBySequence(sessionID int64, after int64, limit int) ([]Record, error) {
+	records := make([]Record, 0)
+	err := sink.scan(func(entry jsonlEntry) bool {
+		if entry.Record != nil && entry.Record.SessionID == sessionID {
+			records = append(records, *entry.Record)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sequenceRecords(records, after, limit), nil
+}
+
+func (sink *JSONLSink) Stack(sessionID int64, stackID int64) (Stack, error) {
+	var stack *Stack
+	err := sink.scan(func(entry jsonlEntry) bool {
+		if entry.Stack != nil && entry.Stack.SessionID == sessionID && entry.Stack.ID == stackID {
+			stack = entry.Stack
+		}
+		return stack == nil
+	})
+	if err != nil {
+		return Stack{}, err
+	}
+	if stack == nil {
+		return Stack{}, errNoStack(sessionID, stackID)
+	}
+	return *stack, nil
+}
@@ -0,0 +1,104 @@
+package goclear
+
+import "fmt"
+import "sync"
+
+// A MemorySink keeps sessions and records in memory, mostly for tests
+type MemorySink struct {
+	mu       sync.Mutex
+	sessions []Session
+	records  []Record
+	stacks   map[stackKey][]StackFrame
+}
+
+func NewMemorySink() *MemorySink {
+	return &MemorySink{stacks: make(map[stackKey][]StackFrame)}
+}
+
+func init() {
+	RegisterSink("memory", func(path string) (Sink, error) {
+		return NewMemorySink(), nil
+	})
+}
+
+func (sink *MemorySink) OpenSession(session *Session) error {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	session.ID = int64(len(sink.sessions) + 1)
+	sink.sessions = append(sink.sessions, *session)
+	return nil
+}
+
+func (sink *MemorySink) WriteBatch(records []Record) error {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	for _, record := range records {
+		record.ID = int64(len(sink.records) + 1)
+		if record.StackID != 0 && len(record.Stack) > 0 {
+			sink.stacks[stackKey{record.SessionID, record.StackID}] = record.Stack
+		}
+		record.Stack = nil
+		sink.records = append(sink.records, record)
+	}
+	return nil
+}
+
+func (sink *MemorySink) CloseSession(session *Session) error {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	for i := range sink.sessions {
+		if sink.sessions[i].ID == session.ID {
+			sink.sessions[i] = *session
+			return nil
+		}
+	}
+	return fmt.Errorf("goclear: no session %d", session.ID)
+}
+
+// Sessions returns the newest session first, like the other sources
+func (sink *MemorySink) Sessions() ([]Session, error) {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	sessions := make([]Session, len(sink.sessions))
+	for i, session := range sink.sessions {
+		sessions[len(sessions)-1-i] = session
+	}
+	return sessions, nil
+}
+
+func (sink *MemorySink) Records(sessionID int64, after int64, limit int) ([]Record, error) {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	records := make([]Record, 0)
+	for _, record := range sink.records {
+		if len(records) == limit {
+			break
+		}
+		if record.SessionID == sessionID && record.ID > after {
+			records = append(records, record)
+		}
+	}
+	return records, nil
+}
+
+func (sink *MemorySink) RecordsBySequence(sessionID int64, after int64, limit int) ([]Record, error) {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	records := make([]Record, 0)
+	for _, record := range sink.records {
+		if record.SessionID == sessionID {
+			records = append(records, record)
+		}
+	}
+	return sequenceRecords(records, after, limit), nil
+}
+
+func (sink *MemorySink) Stack(sessionID int64, stackID int64) (Stack, error) {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	frames, ok := sink.stacks[stackKey{sessionID, stackID}]
+	if !ok {
+		return Stack{}, errNoStack(sessionID, stackID)
+	}
+	return Stack{sessionID, stackID, frames}, nil
+}
@@ -0,0 +1,203 @@
+package goclear
+
+import "database/sql"
+import "encoding/json"
+import "errors"
+import "strings"
+import "github.com/go-sql-driver/mysql"
+
+// A MySQLSink stores sessions and records in the Session and Record tables of a MySQL database
+type MySQLSink struct {
+	db     *sql.DB
+	stacks *storedStacks
+}
+
+var mysqlMigrations = &migrationSet{
+	driver:        "mysql",
+	insertVersion: "insert into schema_version (version, description, timestamp) values (?, ?, ?)",
+	// Wait at most a minute for another process migrating the database
+	lock:           "select get_lock('goclear_migrate', 60)",
+	unlock:         "select release_lock('goclear_migrate')",
+	alreadyApplied: mysqlAlreadyApplied,
+	migrations: []Migration{
+		{1, "Create the Session and Record tables", []string{
+			"create table if not exists Session (id INT AUTO_INCREMENT PRIMARY KEY , timestamp INTEGER, hostname TEXT, path TEXT)",
+			"create table if not exists Record (id INT AUTO_INCREMENT PRIMARY KEY, sessionID INTEGER REFERENCES Session (id), timestamp INTEGER, name TEXT, data TEXT)",
+		}},
+		{2, "Index records by session and by name", []string{
+			"create index record_session_idx on Record (sessionID, id)",
+			"create index record_name_idx on Record (sessionID, name(191), id)",
+		}},
+		{3, "Keep the records dropped in each session", []string{
+			"alter table Session add column drops TEXT",
+		}},
+		{4, "Keep the metrics of each session", []string{
+			"alter table Session add column metrics TEXT",
+		}},
+		{5, "Keep the metadata of each session", []string{
+			"alter table Session add column metadata TEXT",
+		}},
+		{6, "Keep where each record was dumped from", []string{
+			"alter table Record add column file TEXT, add column line INTEGER, add column function TEXT, add column goroutine BIGINT",
+		}},
+		{7, "Keep the stack traces of records in a stack table", []string{
+			"create table if not exists Stack (sessionID INTEGER, id INTEGER, frames TEXT, PRIMARY KEY (sessionID, id))",
+			"alter table Record add column stackID INTEGER",
+		}},
+		{8, "Keep the capture time and sequence number of records", []string{
+			"alter table Record add column timestampNano BIGINT, add column offsetNano BIGINT, add column seq BIGINT",
+			"update Record set seq = id where seq is null",
+			"create index record_seq_idx on Record (sessionID, seq)",
+		}},
+	},
+}
+
+// The errors of a DDL statement applied before: table exists, duplicate column, duplicate key
+func mysqlAlreadyApplied(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	if !errors.As(err, &mysqlErr) {
+		return false
+	}
+	return mysqlErr.Number == 1050 || mysqlErr.Number == 1060 || mysqlErr.Number == 1061
+}
+
+func init() {
+	RegisterSink("mysql", func(path string) (Sink, error) {
+		return NewMySQLSink(path)
+	})
+	registerMigrations("mysql", mysqlMigrations)
+}
+
+// NewMySQLSink opens the database at path (e.g. "root@/goclear") and migrates it to the latest schema
+func NewMySQLSink(path string) (*MySQLSink, error) {
+	db, err := sql.Open("mysql", path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := mysqlMigrations.migrate(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &MySQLSink{db: db, stacks: newStoredStacks()}, nil
+}
+
+// ExecuteSQL runs a statement on the database of the default recorder, when it writes to MySQL.
+// It returns nil before Start, with another backend, or if the statement fails
+func ExecuteSQL(query string) sql.Result {
+	return ExecuteSQLWithArguments(query)
+}
+
+func ExecuteSQLWithArguments(sqlfmt string, args ...interface{}) sql.Result {
+	r := getDefaultRecorder()
+	if r == nil {
+		return nil
+	}
+	sink, ok := r.sink.(*MySQLSink)
+	if !ok {
+		return nil
+	}
+	result, _ := sink.executeSQL(sqlfmt, args...)
+	return result
+}
+
+func (sink *MySQLSink) executeSQL(sqlfmt string, args ...interface{}) (sql.Result, error) {
+	result, err := sink.db.Exec(sqlfmt, args...)
+	if err != nil {
+		logError("Fail to execute SQL", "backend", "mysql", "sql", sqlfmt, "error", err)
+	}
+	return result, err
+}
+
+func (sink *MySQLSink) OpenSession(session *Session) error {
+	newSessionStmt := "insert into Session (timestamp, hostname, path, metadata) values (?, ?, ?, ?)"
+	result, err := sink.executeSQL(newSessionStmt, session.Timestamp, session.Hostname, session.Path,
+		encodeColumn(session.Metadata, session.Metadata == nil))
+	if err != nil {
+		return err
+	}
+	// keep record of the session id
+	session.ID, err = result.LastInsertId()
+	return err
+}
+
+func (sink *MySQLSink) WriteBatch(records []Record) error {
+	err := insertRecords(sink.db, records, func(n int) string {
+		return "(" + strings.Repeat("?, ", recordInsertColumns-1) + "?)"
+	}, "insert ignore into Stack (sessionID, id, frames) values (?, ?, ?)", sink.stacks)
+	if err != nil {
+		logError("Fail to insert records", "backend", "mysql", "records", len(records), "error", err)
+	}
+	return err
+}
+
+func (sink *MySQLSink) CloseSession(session *Session) error {
+	_, err := sink.db.Exec("update Session set drops=?, metrics=?, metadata=? where id=?",
+		encodeColumn(session.Drops, len(session.Drops) == 0), encodeColumn(session.Metrics, session.Metrics == nil),
+		encodeColumn(session.Metadata, session.Metadata == nil), session.ID)
+	return err
+}
+
+func (sink *MySQLSink) Close() error {
+	return sink.db.Close()
+}
+
+func (sink *MySQLSink) Sessions() ([]Session, error) {
+	rows, err := sink.db.Query("select id, timestamp, hostname, path, drops, metrics, metadata from Session order by id desc")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	sessions := make([]Session, 0)
+	for rows.Next() {
+		var s Session
+		var drops, metrics, metadata sql.NullString
+		if err := rows.Scan(&s.ID, &s.Timestamp, &s.Hostname, &s.Path, &drops, &metrics, &metadata); err != nil {
+			return nil, err
+		}
+		decodeColumn(drops, &s.Drops)
+		decodeColumn(metrics, &s.Metrics)
+		decodeColumn(metadata, &s.Metadata)
+		sessions = append(sessions, s)
+	}
+	return sessions, rows.Err()
+}
+
+func (sink *MySQLSink) Records(sessionID int64, after int64, limit int) ([]Record, error) {
+	q := "select id, sessionID, timestamp, name, data, " + recordAddedColumns + " from Record where sessionID=? and id>? order by id limit ?"
+	return sink.queryRecords(q, sessionID, after, limit)
+}
+
+func (sink *MySQLSink) RecordsBySequence(sessionID int64, after int64, limit int) ([]Record, error) {
+	q := "select id, sessionID, timestamp, name, data, " + recordAddedColumns + " from Record where sessionID=? and seq>? order by seq limit ?"
+	return sink.queryRecords(q, sessionID, after, limit)
+}
+
+func (sink *MySQLSink) queryRecords(q string, args ...interface{}) ([]Record, error) {
+	rows, err := sink.db.Query(q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	records := make([]Record, 0)
+	for rows.Next() {
+		r, err := scanRecord(rows)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, r)
+	}
+	return records, rows.Err()
+}
+
+func (sink *MySQLSink) Stack(sessionID int64, stackID int64) (Stack, error) {
+	var frames string
+	err := sink.db.QueryRow("select frames from Stack where sessionID=? and id=?", sessionID, stackID).Scan(&frames)
+	if err == sql.ErrNoRows {
+		return Stack{}, errNoStack(sessionID, stackID)
+	}
+	if err != nil {
+		return Stack{}, err
+	}
+	stack := Stack{SessionID: sessionID, ID: stackID}
+	return stack, json.Unmarshal([]byte(frames), &stack.Frames)
+}
@@ -0,0 +1,186 @@
+package goclear
+
+import "database/sql"
+import "encoding/json"
+import "fmt"
+import "strings"
+import _ "github.com/lib/pq"
+
+// A PostgresSink stores sessions and records in a PostgreSQL database.
+// The data of a record is kept as JSONB, so that records can be searched by the values they hold
+type PostgresSink struct {
+	db     *sql.DB
+	stacks *storedStacks
+}
+
+var postgresMigrations = &migrationSet{
+	driver:        "postgres",
+	insertVersion: "insert into schema_version (version, description, timestamp) values ($1, $2, $3)",
+	// The key of the advisory lock is "goclear" read as a number
+	lock:   "select 1 from pg_advisory_lock(29114395412226418)",
+	unlock: "select pg_advisory_unlock(29114395412226418)",
+	migrations: []Migration{
+		{1, "Create the Session and Record tables", []string{
+			"create table if not exists Session (id BIGSERIAL PRIMARY KEY, timestamp BIGINT, hostname TEXT, path TEXT)",
+			"create table if not exists Record (id BIGSERIAL PRIMARY KEY, sessionID BIGINT REFERENCES Session (id), timestamp BIGINT, name TEXT, data JSONB)",
+		}},
+		{2, "Index records by session, by name and by data", []string{
+			"create index if not exists record_session_idx on Record (sessionID, id)",
+			"create index if not exists record_name_idx on Record (sessionID, name, id)",
+			"create index if not exists record_data_idx on Record using gin (data jsonb_path_ops)",
+		}},
+		{3, "Keep the records dropped in each session", []string{
+			"alter table Session add column if not exists drops JSONB",
+		}},
+		{4, "Keep the metrics of each session", []string{
+			"alter table Session add column if not exists metrics JSONB",
+		}},
+		{5, "Keep the metadata of each session", []string{
+			"alter table Session add column if not exists metadata JSONB",
+		}},
+		{6, "Keep where each record was dumped from", []string{
+			"alter table Record add column if not exists file TEXT, add column if not exists line INTEGER, add column if not exists function TEXT, add column if not exists goroutine BIGINT",
+		}},
+		{7, "Keep the stack traces of records in a stack table", []string{
+			"create table if not exists Stack (sessionID BIGINT REFERENCES Session (id), id BIGINT, frames JSONB, PRIMARY KEY (sessionID, id))",
+			"alter table Record add column if not exists stackID BIGINT",
+		}},
+		{8, "Keep the capture time and sequence number of records", []string{
+			"alter table Record add column if not exists timestampNano BIGINT, add column if not exists offsetNano BIGINT, add column if not exists seq BIGINT",
+			"update Record set seq = id where seq is null",
+			"create index if not exists record_seq_idx on Record (sessionID, seq)",
+		}},
+	},
+}
+
+func init() {
+	RegisterSink("postgres", func(path string) (Sink, error) {
+		return NewPostgresSink(path)
+	})
+	registerMigrations("postgres", postgresMigrations)
+}
+
+// NewPostgresSink opens the database at path, a lib/pq connection string
+// (e.g. "postgres://localhost/goclear?sslmode=disable"), and migrates it to the latest schema
+func NewPostgresSink(path string) (*PostgresSink, error) {
+	db, err := sql.Open("postgres", path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := postgresMigrations.migrate(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &PostgresSink{db: db, stacks: newStoredStacks()}, nil
+}
+
+func (sink *PostgresSink) OpenSession(session *Session) error {
+	// Postgres has no LastInsertId, the id is returned by the insert
+	newSessionStmt := "insert into Session (timestamp, hostname, path, metadata) values ($1, $2, $3, $4::jsonb) returning id"
+	return sink.db.QueryRow(newSessionStmt, session.Timestamp, session.Hostname, session.Path,
+		encodeColumn(session.Metadata, session.Metadata == nil)).Scan(&session.ID)
+}
+
+func (sink *PostgresSink) WriteBatch(records []Record) error {
+	err := insertRecords(sink.db, records, func(n int) string {
+		placeholders := make([]string, recordInsertColumns)
+		for i := range placeholders {
+			placeholders[i] = fmt.Sprintf("$%d", recordInsertColumns*n+i+1)
+		}
+		placeholders[3] += "::jsonb"
+		return "(" + strings.Join(placeholders, ", ") + ")"
+	}, "insert into Stack (sessionID, id, frames) values ($1, $2, $3::jsonb) on conflict do nothing", sink.stacks)
+	if err != nil {
+		logError("Fail to insert records", "backend", "postgres", "records", len(records), "error", err)
+	}
+	return err
+}
+
+func (sink *PostgresSink) CloseSession(session *Session) error {
+	_, err := sink.db.Exec("update Session set drops=$1::jsonb, metrics=$2::jsonb, metadata=$3::jsonb where id=$4",
+		encodeColumn(session.Drops, len(session.Drops) == 0), encodeColumn(session.Metrics, session.Metrics == nil),
+		encodeColumn(session.Metadata, session.Metadata == nil), session.ID)
+	return err
+}
+
+func (sink *PostgresSink) Close() error {
+	return sink.db.Close()
+}
+
+func (sink *PostgresSink) Sessions() ([]Session, error) {
+	rows, err := sink.db.Query("select id, timestamp, hostname, path, drops::text, metrics::text, metadata::text from Session order by id desc")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	sessions := make([]Session, 0)
+	for rows.Next() {
+		var s Session
+		var drops, metrics, metadata sql.NullString
+		if err := rows.Scan(&s.ID, &s.Timestamp, &s.Hostname, &s.Path, &drops, &metrics, &metadata); err != nil {
+			return nil, err
+		}
+		decodeColumn(drops, &s.Drops)
+		decodeColumn(metrics, &s.Metrics)
+		decodeColumn(metadata, &s.Metadata)
+		sessions = append(sessions, s)
+	}
+	return sessions, rows.Err()
+}
+
+func (sink *PostgresSink) queryRecords(q string, args ...interface{}) ([]Record, error) {
+	rows, err := sink.db.Query(q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	records := make([]Record, 0)
+	for rows.Next() {
+		r, err := scanRecord(rows)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, r)
+	}
+	return records, rows.Err()
+}
+
+func (sink *PostgresSink) Records(sessionID int64, after int64, limit int) ([]Record, error) {
+	q := "select id, sessionID, timestamp, name, data::text, " + recordAddedColumns + " from Record where sessionID=$1 and id>$2 order by id limit $3"
+	return sink.queryRecords(q, sessionID, after, limit)
+}
+
+func (sink *PostgresSink) RecordsBySequence(sessionID int64, after int64, limit int) ([]Record, error) {
+	q := "select id, sessionID, timestamp, name, data::text, " + recordAddedColumns + " from Record where sessionID=$1 and seq>$2 order by seq limit $3"
+	return sink.queryRecords(q, sessionID, after, limit)
+}
+
+// RecordsWithValue finds the records whose data holds value at path, a list of object keys
+// from the root of the dumped VarDict, e.g. {"value", "Name", "value"} for the field Name of a struct.
+// A sessionID of 0 searches all the sessions. The search uses the GIN index on data
+func (sink *PostgresSink) RecordsWithValue(sessionID int64, path []string, value interface{}, limit int) ([]Record, error) {
+	// Build the document {path[0]: {path[1]: ... value}}, that matching records contain
+	contained := encodeNumber(value)
+	for i := len(path) - 1; i >= 0; i-- {
+		contained = map[string]interface{}{path[i]: contained}
+	}
+	doc, err := json.Marshal(contained)
+	if err != nil {
+		return nil, err
+	}
+	q := "select id, sessionID, timestamp, name, data::text, " + recordAddedColumns + " from Record where data @> $1::jsonb and ($2::bigint=0 or sessionID=$2::bigint) order by id limit $3"
+	return sink.queryRecords(q, string(doc), sessionID, limit)
+}
+
+func (sink *PostgresSink) Stack(sessionID int64, stackID int64) (Stack, error) {
+	var frames string
+	err := sink.db.QueryRow("select frames::text from Stack where sessionID=$1 and id=$2", sessionID, stackID).Scan(&frames)
+	if err == sql.ErrNoRows {
+		return Stack{}, errNoStack(sessionID, stackID)
+	}
+	if err != nil {
+		return Stack{}, err
+	}
+	stack := Stack{SessionID: sessionID, ID: stackID}
+	return stack, json.Unmarshal([]byte(frames), &stack.Frames)
+}
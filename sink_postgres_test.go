@@ -0,0 +1,65 @@
+package goclear
+
+import "os"
+import "testing"
+
+// The tests run against the database in GOCLEAR_POSTGRES, e.g.
+// "postgres://localhost/goclear_test?sslmode=disable". Its tables are dropped first
+func openTestPostgresSink(t *testing.T) *PostgresSink {
+	path := os.Getenv("GOCLEAR_POSTGRES")
+	if path == "" {
+		t.Skip("GOCLEAR_POSTGRES is not set")
+	}
+	sink, err := NewPostgresSink(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sink.db.Exec("drop table Stack, Record, Session, schema_version"); err != nil {
+		t.Fatal(err)
+	}
+	sink.Close()
+	if sink, err = NewPostgresSink(path); err != nil {
+		t.Fatal(err)
+	}
+	return sink
+}
+
+func TestPostgresSink(t *testing.T) {
+	sink := openTestPostgresSink(t)
+	defer sink.Close()
+	checkSinkRoundTrip(t, sink)
+}
+
+func TestPostgresRecordsWithValue(t *testing.T) {
+	sink := openTestPostgresSink(t)
+	defer sink.Close()
+	session := Session{Timestamp: 1}
+	if err := sink.OpenSession(&session); err != nil {
+		t.Fatal(err)
+	}
+	type point struct{ X, Y int }
+	for _, p := range []point{{1, 2}, {3, 2}, {1, 4}} {
+		record := Record{SessionID: session.ID, Name: "p", Data: GetVarDict("p", p).Dump()}
+		if err := sink.WriteBatch([]Record{record}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	records, err := sink.RecordsWithValue(session.ID, []string{"value", "X", "value"}, 1, 10)
+	if err != nil || len(records) != 2 {
+		t.Errorf("expected 2 records with X=1: %v %v", records, err)
+	}
+	records, err = sink.RecordsWithValue(0, []string{"value", "Y", "value"}, 4, 10)
+	if err != nil || len(records) != 1 {
+		t.Errorf("expected 1 record with Y=4: %v %v", records, err)
+	}
+}
+
+func TestPostgresMigrate(t *testing.T) {
+	sink := openTestPostgresSink(t)
+	sink.Close()
+	// The sink migrated the database when opened, nothing is left to apply
+	applied, version, err := Migrate("postgres", os.Getenv("GOCLEAR_POSTGRES"))
+	if err != nil || len(applied) != 0 || version != len(postgresMigrations.migrations) {
+		t.Errorf("expected an up to date schema: %v %d %v", applied, version, err)
+	}
+}
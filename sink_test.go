@@ -0,0 +1,173 @@
+package goclear
+
+import "testing"
+import "context"
+import "errors"
+import "path/filepath"
+
+// Write two sessions to a sink, and read them back
+func checkSinkRoundTrip(t *testing.T, sink Sink) {
+	s1 := Session{Timestamp: 1, Hostname: "host", Path: "/a"}
+	s2 := Session{Timestamp: 2, Hostname: "host", Path: "/b"}
+	if err := sink.OpenSession(&s1); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.OpenSession(&s2); err != nil {
+		t.Fatal(err)
+	}
+	if s1.ID == 0 || s1.ID == s2.ID {
+		t.Fatalf("sessions should get distinct ids: %d %d", s1.ID, s2.ID)
+	}
+	frames := []StackFrame{{"main.run", "/src/a.go", 7}, {"main.main", "/src/main.go", 3}}
+	batch := []Record{
+		{SessionID: s1.ID, Timestamp: 1, Name: "a", Data: "{}", Caller: Caller{File: "/src/a.go", Line: 7, Function: "main.run", Goroutine: 18},
+			StackID: 1, Stack: frames},
+		{SessionID: s2.ID, Timestamp: 1, Name: "b", Data: "{}"},
+		{SessionID: s1.ID, Timestamp: 2, Name: "c", Data: "{}", StackID: 1, Stack: frames},
+	}
+	if err := sink.WriteBatch(batch); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.CloseSession(&s1); err != nil {
+		t.Fatal(err)
+	}
+
+	source := sink.(Source)
+	sessions, err := source.Sessions()
+	if err != nil || len(sessions) != 2 || sessions[0].ID != s2.ID {
+		t.Errorf("expected the newest session first: %v %v", sessions, err)
+	}
+	records, err := source.Records(s1.ID, 0, 10)
+	if err != nil || len(records) != 2 || records[0].Name != "a" || records[1].Name != "c" {
+		t.Fatalf("unexpected records of session 1: %v %v", records, err)
+	}
+	if records[0].Caller != batch[0].Caller {
+		t.Errorf("expected the caller to be kept, got %+v", records[0].Caller)
+	}
+	after, _ := source.Records(s1.ID, records[0].ID, 1)
+	if len(after) != 1 || after[0].Name != "c" {
+		t.Errorf("expected paging after the first record: %v", after)
+	}
+
+	// The records keep the id of their stack, the frames are in the stack table
+	if records[0].StackID != 1 || records[1].StackID != 1 || records[0].Stack != nil {
+		t.Errorf("expected records referring to stack 1: %+v", records)
+	}
+	stack, err := sink.(StackSource).Stack(s1.ID, 1)
+	if err != nil || len(stack.Frames) != 2 || stack.Frames[1] != frames[1] {
+		t.Errorf("unexpected stack: %+v %v", stack, err)
+	}
+	if _, err := sink.(StackSource).Stack(s2.ID, 1); err == nil {
+		t.Error("stacks belong to their session")
+	}
+}
+
+// A Source hiding the RecordsBySequence of the sink it wraps
+type plainSource struct {
+	Source
+}
+
+// Sources without RecordsBySequence are sorted, records without sequence numbers follow their ids
+func TestRecordsBySequence(t *testing.T) {
+	sink, err := NewJSONLSink(filepath.Join(t.TempDir(), "goclear.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	session := Session{}
+	sink.OpenSession(&session)
+	sink.WriteBatch([]Record{
+		{SessionID: session.ID, Name: "c", Sequence: 3},
+		{SessionID: session.ID, Name: "a", Sequence: 1},
+		{SessionID: session.ID, Name: "b", Sequence: 2},
+	})
+	for _, source := range []Source{sink, plainSource{sink}} {
+		records, err := RecordsBySequence(source, session.ID, 1, 10)
+		if err != nil || len(records) != 2 || records[0].Name != "b" || records[1].Name != "c" {
+			t.Errorf("expected b and c, got %v %v", records, err)
+		}
+	}
+
+	legacy := Session{}
+	sink.OpenSession(&legacy)
+	sink.WriteBatch([]Record{{SessionID: legacy.ID, Name: "old"}, {SessionID: legacy.ID, Name: "older"}})
+	records, _ := RecordsBySequence(plainSource{sink}, legacy.ID, 0, 1)
+	if len(records) != 1 || records[0].Name != "old" || records[0].Sequence != records[0].ID {
+		t.Errorf("expected the first legacy record numbered by its id, got %v", records)
+	}
+}
+
+func TestMemorySink(t *testing.T) {
+	checkSinkRoundTrip(t, NewMemorySink())
+}
+
+func TestMemorySinkCloseUnknownSession(t *testing.T) {
+	sink := NewMemorySink()
+	for _, id := range []int64{0, 1} {
+		if err := sink.CloseSession(&Session{ID: id}); err == nil {
+			t.Errorf("expected an error closing unknown session %d", id)
+		}
+	}
+}
+
+// The SQL helpers run nothing unless the default recorder writes to MySQL
+func TestExecuteSQLWithoutMySQL(t *testing.T) {
+	if ExecuteSQL("select 1") != nil {
+		t.Error("expected no result before Start")
+	}
+	if _, err := Start(Configuration{MaxDepth: 5, Sink: NewMemorySink(), SpoolDir: t.TempDir()}); err != nil {
+		t.Fatal(err)
+	}
+	defer Stop(context.Background())
+	if ExecuteSQLWithArguments("select ?", 1) != nil {
+		t.Error("expected no result with a memory sink")
+	}
+}
+
+func TestJSONLSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "goclear.jsonl")
+	sink, err := OpenSink("jsonl", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSinkRoundTrip(t, sink)
+	sink.(*JSONLSink).Close()
+
+	// Reopening continues the ids of the file
+	reopened, err := NewJSONLSink(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	s3 := Session{Timestamp: 3}
+	reopened.OpenSession(&s3)
+	if s3.ID != 3 {
+		t.Errorf("expected session id 3 after reopening, got %d", s3.ID)
+	}
+}
+
+// A single writer at a time gives out the ids, readers open the file meanwhile
+func TestJSONLSinkLocked(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "goclear.jsonl")
+	sink, err := NewJSONLSink(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	if _, err := NewJSONLSink(path); !errors.Is(err, ErrLocked) {
+		t.Fatalf("expected a second writer to be refused, got %v", err)
+	}
+	session := Session{}
+	sink.OpenSession(&session)
+
+	source, err := OpenSource("jsonl", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sessions, err := source.Sessions(); err != nil || len(sessions) != 1 {
+		t.Errorf("expected the session of the writer: %v %v", sessions, err)
+	}
+	if err := source.(Sink).OpenSession(&Session{}); err != ErrReadOnly {
+		t.Errorf("expected the source to be read-only, got %v", err)
+	}
+}
@@ -0,0 +1,473 @@
+package goclear
+
+import "crypto/sha256"
+import "encoding/binary"
+import "encoding/hex"
+import "encoding/json"
+import "errors"
+import "fmt"
+import "io"
+import "os"
+import "path/filepath"
+import "sort"
+import "strconv"
+import "strings"
+import "sync"
+import "syscall"
+import "time"
+
+// When the sink fails, the workers write their batches to a spool file in SpoolDir
+// instead, and the records are replayed in order once the sink works again, retrying
+// with an exponential backoff. A spool file is:
+//	[replayed offset int64] - the records before it were written to the sink
+//	[frame: spoolHeader]    - which backend the records are for
+//	[frames: Record]...
+// A batch failing spoolAttempts times is written one record at a time: the records
+// the sink keeps refusing go to a dead letter file, dead-<pid>-<session>-<timestamp>.log,
+// and are reported lost.
+// Files left by a process that is no longer running are replayed by the next
+// Recorder opened on the same backend, or the custom Sink of the same SinkName,
+// before its own records. The records spooled for a custom Sink without a SinkName
+// are only retried by their own Recorder: what is left when it closes is lost
+type spool struct {
+	file *os.File
+	// Records start at start, are read back from readOffset and written at writeOffset
+	start       int64
+	readOffset  int64
+	writeOffset int64
+}
+
+// Attempts at writing a batch of the spool before trying its records one by one
+const spoolAttempts = 5
+
+type spoolHeader struct {
+	Backend string `json:"backend"`
+	// A hash of DBPath, which may hold a password
+	PathHash string `json:"pathHash"`
+	Sink    string `json:"sink,omitempty"`
+}
+
+// The header of the spool files for a custom Sink without a SinkName: no other run replays them
+var anonymousSpool = spoolHeader{}
+
+const spoolOffsetSize = 8
+
+func createSpool(path string, header spoolHeader) (*spool, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	payload, _ := json.Marshal(header)
+	start := int64(spoolOffsetSize + frameHeaderSize + len(payload))
+	buf := make([]byte, spoolOffsetSize)
+	binary.LittleEndian.PutUint64(buf, uint64(start))
+	if _, err := file.Write(appendFrame(buf, payload)); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &spool{file: file, start: start, readOffset: start, writeOffset: start}, nil
+}
+
+// Open a spool file left by another process, dropping a frame torn by a crash
+func openSpool(path string) (*spool, spoolHeader, error) {
+	var header spoolHeader
+	file, err := os.OpenFile(path, os.O_RDWR, 0600)
+	if err != nil {
+		return nil, header, err
+	}
+	s := &spool{file: file}
+	buf := make([]byte, spoolOffsetSize)
+	_, err = file.ReadAt(buf, 0)
+	var payload []byte
+	if err == nil {
+		payload, err = readFrame(io.NewSectionReader(file, spoolOffsetSize, 1<<62))
+	}
+	if err == nil {
+		err = json.Unmarshal(payload, &header)
+	}
+	if err != nil {
+		file.Close()
+		return nil, header, err
+	}
+	s.readOffset = int64(binary.LittleEndian.Uint64(buf))
+	s.start = int64(spoolOffsetSize + frameHeaderSize + len(payload))
+	s.writeOffset = s.start
+	for {
+		payload, err := readFrame(io.NewSectionReader(file, s.writeOffset, 1<<62))
+		if err != nil {
+			break
+		}
+		s.writeOffset += int64(frameHeaderSize + len(payload))
+	}
+	if s.readOffset > s.writeOffset {
+		s.readOffset = s.writeOffset
+	}
+	if err := file.Truncate(s.writeOffset); err != nil {
+		file.Close()
+		return nil, header, err
+	}
+	return s, header, nil
+}
+
+func (s *spool) empty() bool {
+	return s.readOffset == s.writeOffset
+}
+
+func (s *spool) append(records []Record) error {
+	buf := make([]byte, 0)
+	for _, record := range records {
+		payload, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		buf = appendFrame(buf, payload)
+	}
+	if _, err := s.file.WriteAt(buf, s.writeOffset); err != nil {
+		return err
+	}
+	// The records are only kept once on disk
+	if err := s.file.Sync(); err != nil {
+		return err
+	}
+	s.writeOffset += int64(len(buf))
+	return nil
+}
+
+// Read at most limit records to replay, and the offset following them
+func (s *spool) read(limit int) ([]Record, int64, error) {
+	records := make([]Record, 0)
+	offset := s.readOffset
+	section := io.NewSectionReader(s.file, offset, s.writeOffset-offset)
+	for len(records) < limit && offset < s.writeOffset {
+		payload, err := readFrame(section)
+		if err != nil {
+			return nil, offset, err
+		}
+		var record Record
+		if err := json.Unmarshal(payload, &record); err != nil {
+			return nil, offset, err
+		}
+		records = append(records, record)
+		offset += int64(frameHeaderSize + len(payload))
+	}
+	return records, offset, nil
+}
+
+// Mark the records before offset as replayed; a file fully replayed is emptied
+func (s *spool) commit(offset int64) error {
+	if offset == s.writeOffset {
+		if err := s.file.Truncate(s.start); err != nil {
+			return err
+		}
+		offset, s.writeOffset = s.start, s.start
+	}
+	buf := make([]byte, spoolOffsetSize)
+	binary.LittleEndian.PutUint64(buf, uint64(offset))
+	if _, err := s.file.WriteAt(buf, 0); err != nil {
+		return err
+	}
+	if err := s.file.Sync(); err != nil {
+		return err
+	}
+	s.readOffset = offset
+	return nil
+}
+
+// The spool files of a Recorder: the leftovers of earlier runs first, then its own
+type spooler struct {
+	mu     sync.Mutex
+	dir    string
+	name   string
+	header spoolHeader
+	files  []*spool
+	own    *spool
+	// The records the sink refuses, kept aside
+	dead *os.File
+	// Signaled when records are spooled
+	wake chan struct{}
+	// Closed when the Recorder closes, to stop waiting before a retry
+	closing chan struct{}
+	done    sync.WaitGroup
+}
+
+func newSpooler(config Configuration, session *Session) *spooler {
+	header := spoolHeader{Backend: config.Backend, PathHash: pathHash(config.DBPath)}
+	if config.Sink != nil {
+		header = spoolHeader{Sink: config.SinkName}
+	}
+	return &spooler{
+		dir:     config.SpoolDir,
+		name:    fmt.Sprintf("spool-%d-%d-%d.log", os.Getpid(), session.ID, session.Timestamp),
+		header:  header,
+		wake:    make(chan struct{}, 1),
+		closing: make(chan struct{}),
+	}
+}
+
+func pathHash(path string) string {
+	sum := sha256.Sum256([]byte(path))
+	return hex.EncodeToString(sum[:])
+}
+
+// Tell whether a process is running; the signal 0 only checks that it can be sent.
+// A process of another user can't be signaled, but it runs
+func processAlive(pid int) bool {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	err = process.Signal(syscall.Signal(0))
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// Take over the spool files for the same backend left by processes no longer running,
+// renaming them to the current process so that no other one takes them too.
+// The files of custom sinks without a name are removed, as no one can replay them
+func (sp *spooler) adoptLeftovers() {
+	paths, _ := filepath.Glob(filepath.Join(sp.dir, "spool-*.log"))
+	sort.Strings(paths)
+	for _, path := range paths {
+		fields := strings.SplitN(strings.TrimPrefix(filepath.Base(path), "spool-"), "-", 2)
+		pid, err := strconv.Atoi(fields[0])
+		if err != nil || len(fields) < 2 || processAlive(pid) {
+			continue
+		}
+		adopted := filepath.Join(sp.dir, fmt.Sprintf("spool-%d-%s", os.Getpid(), fields[1]))
+		if os.Rename(path, adopted) != nil {
+			continue
+		}
+		s, header, err := openSpool(adopted)
+		if err != nil {
+			logWarn("Fail to open spool file", "path", adopted, "error", err)
+			continue
+		}
+		if header == anonymousSpool {
+			logWarn("Removing the spool file of an unnamed sink, its records are lost", "path", adopted)
+			s.file.Close()
+			os.Remove(adopted)
+			continue
+		}
+		if header != sp.header {
+			// For another backend, left for a Recorder using it
+			s.file.Close()
+			os.Rename(adopted, path)
+			continue
+		}
+		if s.empty() {
+			s.file.Close()
+			os.Remove(adopted)
+			continue
+		}
+		logInfo("Replaying records of an earlier run", "path", adopted)
+		sp.files = append(sp.files, s)
+	}
+}
+
+// Tell whether records wait in the spool, so that new ones must follow them
+func (sp *spooler) busy() bool {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	for _, s := range sp.files {
+		if !s.empty() {
+			return true
+		}
+	}
+	return false
+}
+
+func (sp *spooler) append(records []Record) error {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	if sp.own == nil {
+		if err := os.MkdirAll(sp.dir, 0700); err != nil {
+			return err
+		}
+		own, err := createSpool(filepath.Join(sp.dir, sp.name), sp.header)
+		if err != nil {
+			return err
+		}
+		sp.own = own
+		sp.files = append(sp.files, own)
+	}
+	if err := sp.own.append(records); err != nil {
+		return err
+	}
+	select {
+	case sp.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// The first file with records to replay, or nil
+func (sp *spooler) next() *spool {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	for _, s := range sp.files {
+		if !s.empty() {
+			return s
+		}
+	}
+	return nil
+}
+
+// Write the spooled records to the sink, waiting longer after each failure.
+// When the Recorder closes, a last attempt is made, and what is left stays on disk
+func (r *Recorder) replaySpool() {
+	defer r.spooler.done.Done()
+	sp := r.spooler
+	backoff := r.config.RetryInterval
+	// Failed attempts at the batch at the head of the spool
+	attempts := 0
+	for {
+		s := sp.next()
+		closing := false
+		select {
+		case <-sp.closing:
+			closing = true
+		default:
+		}
+		if s == nil {
+			if closing {
+				return
+			}
+			// Nothing to replay until records are spooled
+			select {
+			case <-sp.closing:
+			case <-sp.wake:
+			}
+			continue
+		}
+		sp.mu.Lock()
+		records, offset, err := s.read(r.config.BatchSize)
+		sp.mu.Unlock()
+		if err == nil {
+			attempts++
+			if attempts > spoolAttempts {
+				err = r.replayEach(records)
+			} else {
+				err = r.replay(records)
+			}
+		} else {
+			logError("Fail to read spool file, skipping the rest", "path", s.file.Name(), "error", err)
+			r.reportError(&RecordError{Kind: ErrSink, Lost: true, Cause: err})
+			offset, err = s.writeOffset, nil
+		}
+		if err != nil {
+			if closing {
+				return
+			}
+			select {
+			case <-sp.closing:
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+			if backoff > r.config.MaxRetryInterval {
+				backoff = r.config.MaxRetryInterval
+			}
+			continue
+		}
+		backoff = r.config.RetryInterval
+		attempts = 0
+		sp.mu.Lock()
+		if err := s.commit(offset); err != nil {
+			logWarn("Fail to update spool file", "path", s.file.Name(), "error", err)
+		}
+		sp.removeReplayed()
+		sp.mu.Unlock()
+	}
+}
+
+func (r *Recorder) replay(records []Record) error {
+	start := time.Now()
+	err := r.sink.WriteBatch(records)
+	if err == nil {
+		r.metrics.written(len(records), time.Since(start))
+	}
+	return err
+}
+
+// Write the records one at a time, after the batch failed spoolAttempts times.
+// The records the sink still refuses while it takes others are moved to the dead letter file,
+// so that they no longer hold back those following them. If it refuses them all, it is down
+func (r *Recorder) replayEach(records []Record) error {
+	refused := make([]Record, 0)
+	var err error
+	for _, record := range records {
+		if writeErr := r.replay([]Record{record}); writeErr != nil {
+			refused = append(refused, record)
+			err = writeErr
+		}
+	}
+	if len(refused) == len(records) {
+		return err
+	}
+	for _, record := range refused {
+		logError("Sink refuses a spooled record, moving it to the dead letter file", "name", record.Name, "error", err)
+		if deadErr := r.spooler.deadLetter(record); deadErr != nil {
+			logError("Fail to write the dead letter file", "error", deadErr)
+		}
+		r.reportError(&RecordError{Kind: ErrSink, Name: record.Name, Records: 1, Lost: true, Cause: err})
+	}
+	return nil
+}
+
+// Append a record the sink refuses to the dead letter file of the recorder, created when needed
+func (sp *spooler) deadLetter(record Record) error {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	if sp.dead == nil {
+		if err := os.MkdirAll(sp.dir, 0700); err != nil {
+			return err
+		}
+		name := "dead-" + strings.TrimPrefix(sp.name, "spool-")
+		dead, err := os.OpenFile(filepath.Join(sp.dir, name), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return err
+		}
+		sp.dead = dead
+	}
+	payload, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if _, err := sp.dead.Write(appendFrame(nil, payload)); err != nil {
+		return err
+	}
+	return sp.dead.Sync()
+}
+
+// Remove the files of earlier runs fully replayed, the caller holding the lock
+func (sp *spooler) removeReplayed() {
+	files := sp.files[:0]
+	for _, s := range sp.files {
+		if s != sp.own && s.empty() {
+			s.file.Close()
+			os.Remove(s.file.Name())
+		} else {
+			files = append(files, s)
+		}
+	}
+	sp.files = files
+}
+
+// Stop replaying, and remove the files fully replayed, or left for no one to replay
+func (sp *spooler) close() {
+	close(sp.closing)
+	sp.done.Wait()
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	for _, s := range sp.files {
+		s.file.Close()
+		if !s.empty() && s == sp.own && sp.header == anonymousSpool {
+			logWarn("Removing the spool file of an unnamed sink, its records are lost", "path", s.file.Name())
+			os.Remove(s.file.Name())
+		} else if s.empty() {
+			os.Remove(s.file.Name())
+		}
+	}
+	sp.files = nil
+	if sp.dead != nil {
+		sp.dead.Close()
+	}
+}
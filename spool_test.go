@@ -0,0 +1,211 @@
+package goclear
+
+import "context"
+import "errors"
+import "fmt"
+import "os"
+import "path/filepath"
+import "strings"
+import "sync/atomic"
+import "testing"
+import "time"
+
+// A sink failing its writes while down is set
+type flakySink struct {
+	*MemorySink
+	down int32
+}
+
+func (sink *flakySink) WriteBatch(records []Record) error {
+	if atomic.LoadInt32(&sink.down) == 1 {
+		return errors.New("sink is down")
+	}
+	return sink.MemorySink.WriteBatch(records)
+}
+
+func spoolFiles(t *testing.T, dir string) []string {
+	paths, err := filepath.Glob(filepath.Join(dir, "spool-*.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return paths
+}
+
+func TestSpoolRetry(t *testing.T) {
+	dir := t.TempDir()
+	sink := &flakySink{MemorySink: NewMemorySink(), down: 1}
+	r, err := NewRecorder(Configuration{MaxDepth: 5, Sink: sink, BatchSize: 2, SpoolDir: dir,
+		RetryInterval: time.Millisecond, MaxRetryInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		r.DumpVar("x", i)
+	}
+	r.Flush(context.Background())
+	if records, _ := sink.Records(r.SessionID(), 0, 10); len(records) != 0 || len(spoolFiles(t, dir)) != 1 {
+		t.Fatalf("expected the records to be spooled: %v", records)
+	}
+
+	atomic.StoreInt32(&sink.down, 0)
+	r.DumpVar("x", 5)
+	deadline := time.Now().Add(5 * time.Second)
+	for len(recordedValues(t, sink, r.SessionID())) < 6 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if fmt.Sprint(recordedValues(t, sink, r.SessionID())) != "[0 1 2 3 4 5]" {
+		t.Errorf("expected the records replayed in order: %v", recordedValues(t, sink, r.SessionID()))
+	}
+	r.Close(context.Background())
+	if files := spoolFiles(t, dir); len(files) != 0 {
+		t.Errorf("expected the spool file to be removed: %v", files)
+	}
+}
+
+func TestSpoolLeftovers(t *testing.T) {
+	dir := t.TempDir()
+	// Spool files of a process that crashed, torn while writing; pids never go above 1<<22
+	deadPid := 1<<22 + 1
+	leftover, _ := createSpool(filepath.Join(dir, fmt.Sprintf("spool-%d-1-1.log", deadPid)), spoolHeader{Sink: "test"})
+	leftover.append([]Record{{SessionID: 1, Name: "old", Data: "{}"}, {SessionID: 1, Name: "old", Data: "{}"}})
+	leftover.file.WriteAt([]byte{1, 2, 3}, leftover.writeOffset)
+	leftover.file.Close()
+	otherPath := filepath.Join(dir, fmt.Sprintf("spool-%d-2-2.log", deadPid))
+	other, _ := createSpool(otherPath, spoolHeader{Backend: "mysql", PathHash: pathHash("root@/goclear")})
+	other.append([]Record{{SessionID: 1, Name: "other", Data: "{}"}})
+	other.file.Close()
+
+	sink := NewMemorySink()
+	r, err := NewRecorder(Configuration{MaxDepth: 5, Sink: sink, SinkName: "test", SpoolDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Close(context.Background())
+	records, _ := sink.Records(1, 0, 10)
+	if len(records) != 2 || records[0].Name != "old" {
+		t.Errorf("expected the records of the crashed run: %v", records)
+	}
+	if _, err := os.Stat(otherPath); err != nil {
+		t.Errorf("expected the spool of another backend to be left alone: %v", err)
+	}
+	if files := spoolFiles(t, dir); len(files) != 1 {
+		t.Errorf("expected the replayed spool to be removed: %v", files)
+	}
+}
+
+// A custom sink without a name replays no leftovers, and those of unnamed sinks are removed
+func TestSpoolLeftoversUnnamedSink(t *testing.T) {
+	dir := t.TempDir()
+	deadPid := 1<<22 + 1
+	namedPath := filepath.Join(dir, fmt.Sprintf("spool-%d-1-1.log", deadPid))
+	named, _ := createSpool(namedPath, spoolHeader{Sink: "test"})
+	named.append([]Record{{SessionID: 1, Name: "named", Data: "{}"}})
+	named.file.Close()
+	unnamedPath := filepath.Join(dir, fmt.Sprintf("spool-%d-2-2.log", deadPid))
+	unnamed, _ := createSpool(unnamedPath, anonymousSpool)
+	unnamed.append([]Record{{SessionID: 1, Name: "unnamed", Data: "{}"}})
+	unnamed.file.Close()
+
+	sink := NewMemorySink()
+	r, err := NewRecorder(Configuration{MaxDepth: 5, Sink: sink, SpoolDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Close(context.Background())
+	if records, _ := sink.Records(1, 0, 10); len(records) != 0 {
+		t.Errorf("expected no leftovers replayed into an unnamed sink: %v", records)
+	}
+	if _, err := os.Stat(namedPath); err != nil {
+		t.Errorf("expected the spool of a named sink to be left alone: %v", err)
+	}
+	if _, err := os.Stat(unnamedPath); !os.IsNotExist(err) {
+		t.Errorf("expected the spool of an unnamed sink to be removed: %v", err)
+	}
+}
+
+// A sink refusing the records of one variable, whatever happens
+type refusingSink struct {
+	*MemorySink
+}
+
+func (sink *refusingSink) WriteBatch(records []Record) error {
+	for _, record := range records {
+		if record.Name == "bad" {
+			return errors.New("refused")
+		}
+	}
+	return sink.MemorySink.WriteBatch(records)
+}
+
+// A record the sink always refuses goes to the dead letter file instead of holding back the others
+func TestSpoolDeadLetter(t *testing.T) {
+	dir := t.TempDir()
+	sink := &refusingSink{NewMemorySink()}
+	lost := make(chan *RecordError, 10)
+	onError := func(err error) {
+		if recordErr := err.(*RecordError); recordErr.Lost {
+			lost <- recordErr
+		}
+	}
+	r, err := NewRecorder(Configuration{MaxDepth: 5, Sink: sink, SpoolDir: dir, OnError: onError,
+		RetryInterval: time.Millisecond, MaxRetryInterval: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.DumpVar("bad", 0)
+	r.Flush(context.Background())
+	for i := 0; i < 10; i++ {
+		r.DumpVar("good", i)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(recordedValues(t, sink, r.SessionID())) < 10 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	r.Close(context.Background())
+	if values := recordedValues(t, sink, r.SessionID()); fmt.Sprint(values) != "[0 1 2 3 4 5 6 7 8 9]" {
+		t.Errorf("expected the good records to be written: %v", values)
+	}
+	select {
+	case recordErr := <-lost:
+		if recordErr.Name != "bad" {
+			t.Errorf("expected bad to be reported lost: %v", recordErr)
+		}
+	default:
+		t.Error("expected the refused record to be reported lost")
+	}
+	paths, _ := filepath.Glob(filepath.Join(dir, "dead-*.log"))
+	if len(paths) != 1 {
+		t.Fatalf("expected a dead letter file: %v", paths)
+	}
+	frames := 0
+	readFrames(paths[0], 0, func(offset int64, payload []byte) error {
+		frames++
+		return nil
+	})
+	if frames != 1 {
+		t.Errorf("expected the refused record in the dead letter file, got %d frames", frames)
+	}
+}
+
+// Spool files are private to the user, and keep no password of the database path
+func TestSpoolFilePrivate(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "spool")
+	config := Configuration{Backend: "mysql", DBPath: "user:secret@/goclear", SpoolDir: dir}
+	sp := newSpooler(config, &Session{ID: 1, Timestamp: 1})
+	if err := sp.append([]Record{{SessionID: 1, Name: "x", Data: "{}"}}); err != nil {
+		t.Fatal(err)
+	}
+	defer sp.close()
+	content, _ := os.ReadFile(sp.own.file.Name())
+	if strings.Contains(string(content), "secret") {
+		t.Error("expected the database path to be hashed in the spool header")
+	}
+	for _, path := range []string{dir, sp.own.file.Name()} {
+		if info, err := os.Stat(path); err != nil || info.Mode().Perm()&0077 != 0 {
+			t.Errorf("expected %s to be private to the user: %v %v", path, info.Mode(), err)
+		}
+	}
+	if !processAlive(os.Getpid()) {
+		t.Error("expected the current process to be alive")
+	}
+}
@@ -0,0 +1,106 @@
+package goclear
+
+import "encoding/binary"
+import "runtime"
+import "sync"
+
+// A Stack is a symbolized stack trace of a session, from the caller of DumpVar outwards.
+// Records refer to it by id: a stack is stored once in the stack table of the sink,
+// however many records share it
+type Stack struct {
+	SessionID int64        `json:"sessionID"`
+	ID        int64        `json:"id"`
+	Frames    []StackFrame `json:"frames"`
+}
+
+type StackFrame struct {
+	Function string `json:"function"`
+	File     string `json:"file"`
+	Line     int    `json:"line"`
+}
+
+// Deeper stacks are cut
+const maxStackDepth = 64
+
+// The stacks captured by a Recorder, keyed by their program counters,
+// so that a stack met again is neither symbolized nor stored again
+type stackTable struct {
+	mu     sync.Mutex
+	ids    map[string]int64
+	frames [][]StackFrame
+}
+
+func newStackTable() *stackTable {
+	return &stackTable{ids: make(map[string]int64)}
+}
+
+// The stack skip frames above the function calling capture, 0 being that function
+func (table *stackTable) capture(skip int) (int64, []StackFrame) {
+	pcs := make([]uintptr, maxStackDepth)
+	// Skip runtime.Callers and capture
+	pcs = pcs[:runtime.Callers(skip+2, pcs)]
+	key := make([]byte, 8*len(pcs))
+	for i, pc := range pcs {
+		binary.LittleEndian.PutUint64(key[8*i:], uint64(pc))
+	}
+	table.mu.Lock()
+	defer table.mu.Unlock()
+	if id, ok := table.ids[string(key)]; ok {
+		return id, table.frames[id-1]
+	}
+	frames := make([]StackFrame, 0, len(pcs))
+	iter := runtime.CallersFrames(pcs)
+	for {
+		frame, more := iter.Next()
+		frames = append(frames, StackFrame{frame.Function, frame.File, frame.Line})
+		if !more {
+			break
+		}
+	}
+	table.frames = append(table.frames, frames)
+	id := int64(len(table.frames))
+	table.ids[string(key)] = id
+	return id, frames
+}
+
+type stackKey struct {
+	sessionID int64
+	id        int64
+}
+
+// The stacks a sink has stored. Records carry the frames of their stack to the sink,
+// which stores the new ones in its stack table and keeps only the StackID of the records
+type storedStacks struct {
+	mu     sync.Mutex
+	stored map[stackKey]bool
+}
+
+func newStoredStacks() *storedStacks {
+	return &storedStacks{stored: make(map[stackKey]bool)}
+}
+
+// The stacks of the records that are not stored yet, each one once
+func (stacks *storedStacks) unstored(records []Record) []Stack {
+	stacks.mu.Lock()
+	defer stacks.mu.Unlock()
+	found := make(map[stackKey]bool)
+	unstored := make([]Stack, 0)
+	for _, record := range records {
+		key := stackKey{record.SessionID, record.StackID}
+		if record.StackID == 0 || len(record.Stack) == 0 || stacks.stored[key] || found[key] {
+			continue
+		}
+		found[key] = true
+		unstored = append(unstored, Stack{record.SessionID, record.StackID, record.Stack})
+	}
+	return unstored
+}
+
+// Mark stacks as stored, once they are written
+func (stacks *storedStacks) add(added ...Stack) {
+	stacks.mu.Lock()
+	defer stacks.mu.Unlock()
+	for _, stack := range added {
+		stacks.stored[stackKey{stack.SessionID, stack.ID}] = true
+	}
+}
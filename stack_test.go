@@ -0,0 +1,59 @@
+package goclear
+
+import "context"
+import "strings"
+import "testing"
+
+func TestStackTrace(t *testing.T) {
+	sink := NewMemorySink()
+	r, err := NewRecorder(Configuration{MaxDepth: 5, Sink: sink, SpoolDir: t.TempDir(), StackNames: []string{"traced"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		r.DumpVarWithStack("x", i)
+	}
+	r.DumpVar("y", 1)
+	r.DumpVar("traced", 1)
+	r.Close(context.Background())
+
+	records, _ := sink.Records(r.SessionID(), 0, 10)
+	if len(records) != 5 {
+		t.Fatalf("expected 5 records, got %d", len(records))
+	}
+	// The same stack is captured once and shared
+	if records[0].StackID == 0 || records[1].StackID != records[0].StackID || records[2].StackID != records[0].StackID {
+		t.Errorf("expected one stack for the loop: %d %d %d", records[0].StackID, records[1].StackID, records[2].StackID)
+	}
+	if records[3].StackID != 0 {
+		t.Error("DumpVar should not capture a stack for other names")
+	}
+	if records[4].StackID == 0 || records[4].StackID == records[0].StackID {
+		t.Errorf("expected a new stack for the traced name, got %d", records[4].StackID)
+	}
+
+	stack, err := sink.Stack(r.SessionID(), records[0].StackID)
+	if err != nil || len(stack.Frames) < 2 {
+		t.Fatalf("expected the frames of the stack: %+v %v", stack, err)
+	}
+	top := stack.Frames[0]
+	if top.Function != records[0].Function || top.Line != records[0].Line || !strings.HasSuffix(top.File, "stack_test.go") {
+		t.Errorf("the stack should start at the caller %+v, got %+v", records[0].Caller, top)
+	}
+	if !strings.HasSuffix(stack.Frames[1].Function, "testing.tRunner") {
+		t.Errorf("expected the test runner below the test, got %+v", stack.Frames[1])
+	}
+}
+
+func TestStackTableDedup(t *testing.T) {
+	table := newStackTable()
+	ids := make([]int64, 0)
+	for i := 0; i < 2; i++ {
+		id, _ := table.capture(0)
+		ids = append(ids, id)
+	}
+	other, _ := table.capture(0)
+	if ids[0] != ids[1] || other == ids[0] || len(table.frames) != 2 {
+		t.Errorf("expected 2 distinct stacks, got %v %d", ids, other)
+	}
+}
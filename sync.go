@@ -0,0 +1,213 @@
+package goclear
+
+import "reflect"
+import "sync"
+import "sync/atomic"
+import "strings"
+import "unsafe"
+
+// Sync primitives and atomics are dumped with dedicated renderers, reading their
+// internal state with atomic loads:
+//	sync.Mutex     - metatype "sync", value {locked, woken, starving, waiters}
+//	sync.RWMutex   - metatype "sync", value {writer, readers, departing, waiters}
+//	sync.WaitGroup - metatype "sync", value {counter, waiters}
+//	sync.Once      - metatype "sync", value {done}
+//	atomic.*       - metatype "atomic", value is the VarDict of the loaded value
+
+// Bits of the state of a sync.Mutex
+const (
+	mutexLocked = 1 << iota
+	mutexWoken
+	mutexStarving
+	mutexWaiterShift = iota
+)
+
+// Readers of a RWMutex are counted negatively by this much while a writer is pending
+const rwmutexMaxReaders = 1 << 30
+
+// The low 32 bits of a WaitGroup state count waiters, except for one flag bit
+const waitGroupWaitersMask = 0x7fffffff
+
+var atomicBoolType = reflect.TypeOf(atomic.Bool{})
+var atomicInt32Type = reflect.TypeOf(atomic.Int32{})
+var atomicInt64Type = reflect.TypeOf(atomic.Int64{})
+var atomicUint32Type = reflect.TypeOf(atomic.Uint32{})
+var atomicUint64Type = reflect.TypeOf(atomic.Uint64{})
+var atomicUintptrType = reflect.TypeOf(atomic.Uintptr{})
+var atomicValueType = reflect.TypeOf(atomic.Value{})
+
+func init() {
+	registerRenderer(reflect.TypeOf(sync.Mutex{}), renderMutex)
+	registerRenderer(reflect.TypeOf(sync.RWMutex{}), renderRWMutex)
+	registerRenderer(reflect.TypeOf(sync.WaitGroup{}), renderWaitGroup)
+	registerRenderer(reflect.TypeOf(sync.Once{}), renderOnce)
+	for _, t := range []reflect.Type{atomicBoolType, atomicInt32Type, atomicInt64Type,
+		atomicUint32Type, atomicUint64Type, atomicUintptrType, atomicValueType} {
+		registerRenderer(t, renderAtomic)
+	}
+	registerRendererMatcher(func(t reflect.Type) renderer {
+		if t.PkgPath() == "sync/atomic" && strings.HasPrefix(t.Name(), "Pointer[") {
+			return renderAtomicPointer
+		}
+		return nil
+	})
+}
+
+// Find a (possibly unexported) field by name, looking into nested structs as well
+func findField(v reflect.Value, name string) (reflect.Value, bool) {
+	if v.Kind() != reflect.Struct {
+		return v, false
+	}
+	if field := v.FieldByName(name); field.IsValid() {
+		return field, true
+	}
+	for i := 0; i < v.NumField(); i++ {
+		if field, ok := findField(v.Field(i), name); ok {
+			return field, true
+		}
+	}
+	return v, false
+}
+
+// Atomically load an addressable field holding an integer or one of the sync/atomic types
+func loadAtomic(field reflect.Value) (interface{}, bool) {
+	p := unsafe.Pointer(field.UnsafeAddr())
+	switch field.Type() {
+	case atomicBoolType:
+		return (*atomic.Bool)(p).Load(), true
+	case atomicInt32Type:
+		return (*atomic.Int32)(p).Load(), true
+	case atomicInt64Type:
+		return (*atomic.Int64)(p).Load(), true
+	case atomicUint32Type:
+		return (*atomic.Uint32)(p).Load(), true
+	case atomicUint64Type:
+		return (*atomic.Uint64)(p).Load(), true
+	case atomicUintptrType:
+		return (*atomic.Uintptr)(p).Load(), true
+	case atomicValueType:
+		return (*atomic.Value)(p).Load(), true
+	}
+	switch field.Kind() {
+	case reflect.Int32:
+		return atomic.LoadInt32((*int32)(p)), true
+	case reflect.Int64:
+		return atomic.LoadInt64((*int64)(p)), true
+	case reflect.Uint32:
+		return atomic.LoadUint32((*uint32)(p)), true
+	case reflect.Uint64:
+		return atomic.LoadUint64((*uint64)(p)), true
+	}
+	return nil, false
+}
+
+// Load a named field of a sync primitive as an int64, whatever its integer type
+func loadStateField(v reflect.Value, name string) int64 {
+	field, ok := findField(v, name)
+	if !ok {
+		return 0
+	}
+	value, ok := loadAtomic(field)
+	if !ok {
+		return 0
+	}
+	switch n := value.(type) {
+	case bool:
+		if n {
+			return 1
+		}
+		return 0
+	case int32:
+		return int64(n)
+	case int64:
+		return n
+	case uint32:
+		return int64(n)
+	case uint64:
+		return int64(n)
+	}
+	return 0
+}
+
+func (w *walker) newSyncVarDict(fields map[string]interface{}, depth int) VarDict {
+	vardict := NewVarDict()
+	vardict.SetMeta("sync")
+	value := make(map[string]interface{})
+	for name, field := range fields {
+		value[name] = w.walk(field, depth+1)
+	}
+	vardict.SetValue(value)
+	return vardict
+}
+
+func mutexState(v reflect.Value) map[string]interface{} {
+	state := int32(loadStateField(v, "state"))
+	return map[string]interface{}{
+		"locked":   state&mutexLocked != 0,
+		"woken":    state&mutexWoken != 0,
+		"starving": state&mutexStarving != 0,
+		"waiters":  state >> mutexWaiterShift,
+	}
+}
+
+func renderMutex(w *walker, v reflect.Value, depth int) VarDict {
+	return w.newSyncVarDict(mutexState(v), depth)
+}
+
+func renderRWMutex(w *walker, v reflect.Value, depth int) VarDict {
+	readers := int32(loadStateField(v, "readerCount"))
+	writer := false
+	if readers < 0 {
+		// A writer has announced itself, the readers are still counted
+		readers += rwmutexMaxReaders
+		writer = true
+	}
+	fields := map[string]interface{}{
+		"writer":    writer,
+		"readers":   readers,
+		"departing": int32(loadStateField(v, "readerWait")),
+		"waiters":   int32(0),
+	}
+	if writerMutex, ok := findField(v, "w"); ok {
+		fields["waiters"] = mutexState(writerMutex)["waiters"]
+	}
+	return w.newSyncVarDict(fields, depth)
+}
+
+func renderWaitGroup(w *walker, v reflect.Value, depth int) VarDict {
+	state := uint64(loadStateField(v, "state"))
+	return w.newSyncVarDict(map[string]interface{}{
+		"counter": int32(state >> 32),
+		"waiters": uint32(state) & waitGroupWaitersMask,
+	}, depth)
+}
+
+func renderOnce(w *walker, v reflect.Value, depth int) VarDict {
+	return w.newSyncVarDict(map[string]interface{}{
+		"done": loadStateField(v, "done") != 0,
+	}, depth)
+}
+
+func renderAtomic(w *walker, v reflect.Value, depth int) VarDict {
+	vardict := NewVarDict()
+	vardict.SetMeta("atomic")
+	value, _ := loadAtomic(v)
+	vardict.SetValue(w.walk(value, depth+1))
+	return vardict
+}
+
+// atomic.Pointer[T] keeps an unsafe.Pointer in field v, and *T in its first field's type
+func renderAtomicPointer(w *walker, v reflect.Value, depth int) VarDict {
+	vardict := NewVarDict()
+	vardict.SetMeta("atomic")
+	ptrType := v.Type().Field(0).Type.Elem()
+	field, ok := findField(v, "v")
+	if !ok {
+		vardict.SetValue(w.walk(nil, depth+1))
+		return vardict
+	}
+	p := atomic.LoadPointer((*unsafe.Pointer)(unsafe.Pointer(field.UnsafeAddr())))
+	ptr := reflect.NewAt(ptrType.Elem(), p)
+	vardict.SetValue(w.walk(ptr.Interface(), depth+1))
+	return vardict
+}
@@ -0,0 +1,95 @@
+package goclear
+
+import "testing"
+import "sync"
+import "sync/atomic"
+
+func syncField(vd VarDict, name string) interface{} {
+	return vd["value"].(map[string]interface{})[name].(VarDict)["value"]
+}
+
+func TestDumpMutex(t *testing.T) {
+	var mu sync.Mutex
+	vd := GetVarDict("mu", &mu)["value"].(VarDict)
+	if vd["metatype"] != "sync" || syncField(vd, "locked") != false {
+		t.Errorf("expected an unlocked mutex, got %v", vd)
+	}
+	mu.Lock()
+	vd = GetVarDict("mu", &mu)["value"].(VarDict)
+	if syncField(vd, "locked") != true {
+		t.Errorf("expected a locked mutex, got %v", vd)
+	}
+	mu.Unlock()
+
+	var rw sync.RWMutex
+	rw.RLock()
+	rw.RLock()
+	vd = GetVarDict("rw", &rw)["value"].(VarDict)
+	if syncField(vd, "readers") != int32(2) || syncField(vd, "writer") != false {
+		t.Errorf("expected 2 readers, got %v", vd)
+	}
+	rw.RUnlock()
+	rw.RUnlock()
+}
+
+func TestDumpWaitGroupAndOnce(t *testing.T) {
+	type Pool struct {
+		Done  sync.WaitGroup
+		once  sync.Once
+		Count atomic.Int64
+		Last  atomic.Pointer[string]
+	}
+	p := &Pool{}
+	p.Done.Add(3)
+	p.once.Do(func() {})
+	p.Count.Store(42)
+	s := "last"
+	p.Last.Store(&s)
+
+	fields := GetVarDict("pool", p)["value"].(VarDict)["value"].(map[string]interface{})
+	if c := syncField(fields["Done"].(VarDict), "counter"); c != int32(3) {
+		t.Errorf("expected counter 3, got %v", c)
+	}
+	if d := syncField(fields["once"].(VarDict), "done"); d != true {
+		t.Errorf("expected the unexported Once to be done, got %v", d)
+	}
+	count := fields["Count"].(VarDict)
+	if count["metatype"] != "atomic" || count["value"].(VarDict)["value"] != int64(42) {
+		t.Errorf("unexpected atomic %v", count)
+	}
+	last := fields["Last"].(VarDict)["value"].(VarDict)
+	if last["metatype"] != "ptr" || last["value"].(VarDict)["value"] != "last" {
+		t.Errorf("unexpected atomic pointer %v", last)
+	}
+	p.Done.Add(-3)
+}
+
+// Atomics and mutexes reached through a pointer are read in place, with atomic loads,
+// while other goroutines use them: no data race under -race
+func TestDumpSyncInPlace(t *testing.T) {
+	type Counter struct {
+		N atomic.Int64
+		M sync.Mutex
+	}
+	c := &Counter{}
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 1000; i++ {
+			c.N.Add(1)
+			c.M.Lock()
+			c.M.Unlock()
+		}
+		close(done)
+	}()
+	for i := 0; i < 100; i++ {
+		fields := GetVarDict("c", c)["value"].(VarDict)["value"].(map[string]interface{})
+		if fields["N"].(VarDict)["metatype"] != "atomic" || fields["M"].(VarDict)["metatype"] != "sync" {
+			t.Fatalf("unexpected fields %v", fields)
+		}
+	}
+	<-done
+	n := GetVarDict("c", c)["value"].(VarDict)["value"].(map[string]interface{})["N"].(VarDict)
+	if n["value"].(VarDict)["value"] != int64(1000) {
+		t.Errorf("expected 1000, got %v", n)
+	}
+}
@@ -4,20 +4,23 @@ import "net/http"
 import "fmt"
 import "os"
 import "encoding/json"
+import "flag"
+import "strings"
 import "github.com/gorilla/mux"
-import "database/sql"
+import "github.com/RealHacker/goclear"
 import "html/template"
 import "strconv"
-import _ "github.com/go-sql-driver/mysql"
 
-var db *sql.DB
+var source goclear.Source
 
 func init() {
 	// TODO: This will come from common config file
-	DBPath := "root@/goclear"
+	backend := flag.String("backend", "mysql", "backend storing the sessions: "+strings.Join(goclear.Backends(), ", "))
+	DBPath := flag.String("path", "root@/goclear", "path of the backend storage")
+	flag.Parse()
 
 	var err error
-	db, err = sql.Open("mysql", DBPath)
+	source, err = goclear.OpenSource(*backend, *DBPath)
 
 	if err != nil {
 		fmt.Println("Fail to initialize database, exit now...", err)
@@ -29,33 +32,17 @@ func main(){
 	router := mux.NewRouter()
 	router.HandleFunc("/", listHandler)
 	router.HandleFunc("/{sessionid:[0-9]+}/", recordsHandler)
-	router.HandleFunc("/{sessionid:[0-9]+}/{recordid}/", recordsHandler)
+	router.HandleFunc("/{sessionid:[0-9]+}/{after}/", recordsHandler)
+	router.HandleFunc("/{sessionid:[0-9]+}/stacks/{stackid:[0-9]+}/", stackHandler)
 	http.ListenAndServe(":8000", router)
 }
 
 func listHandler(w http.ResponseWriter, r *http.Request){
-	sql := "select id, timestamp, hostname, path from Session order by id desc"
-	rows, err := db.Query(sql)
+	sessions, err := source.Sessions()
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	type Session struct {
-		Id int64 `json:"id"`
-		Timestamp int64 `json:"timestamp"`
-		Hostname string `json:"hostname"`	
-		Path string `json:"path"`
-	}
-	sessions := make([]Session, 0)
-	for rows.Next() {
-		var s Session
-		err = rows.Scan(&s.Id, &s.Timestamp, &s.Hostname, &s.Path)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-		sessions = append(sessions, s)
-	}
 	tpl, err := template.ParseFiles("index.html")
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
@@ -75,36 +62,20 @@ func recordsHandler(w http.ResponseWriter, r *http.Request){
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	var recordStart int
-	recordidStr, ok := vars["recordid"]
+	// The records follow the order of the calls to DumpVar, after the given sequence number
+	var after int
+	afterStr, ok := vars["after"]
 	if !ok {
-		recordStart = 0
+		after = 0
 	} else {
-		recordStart, _ = strconv.Atoi(recordidStr)
+		after, _ = strconv.Atoi(afterStr)
 	}
 
-	q := "select id, timestamp, name, data from Record where sessionID=? and id>? order by id limit 10"
-	rows, err := db.Query(q, sessionid, recordStart)
+	records, err := goclear.RecordsBySequence(source, int64(sessionid), int64(after), 10)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	type Record struct {
-		Id int64 `json:"id"`
-		Timestamp int64 `json:"timestamp"`
-		Name string `json:"name"`	
-		Data string `json:"data"`
-	}
-	records := make([]Record, 0)
-	for rows.Next() {
-		var r Record
-		err = rows.Scan(&r.Id, &r.Timestamp, &r.Name, &r.Data)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-		records = append(records, r)
-	}
 	// marshal to json
 	b, err := json.Marshal(records)
 	if err != nil {
@@ -113,4 +84,28 @@ func recordsHandler(w http.ResponseWriter, r *http.Request){
 	}
 	w.Header().Set("Content-Type", "application/json")
 	w.Write(b)
+}
+
+// The frames of a stack of the stack table, for the records with a stackID
+func stackHandler(w http.ResponseWriter, r *http.Request){
+	stacks, ok := source.(goclear.StackSource)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	vars := mux.Vars(r)
+	sessionid, _ := strconv.ParseInt(vars["sessionid"], 10, 64)
+	stackid, _ := strconv.ParseInt(vars["stackid"], 10, 64)
+	stack, err := stacks.Stack(sessionid, stackid)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	b, err := json.Marshal(stack)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
 }
\ No newline at end of file
@@ -1,128 +1,136 @@
 package goclear
 
-import "fmt"
-import "os"
-import "os/signal"
+import "context"
 import "time"
-import "sync"
-import "syscall"
-import "database/sql"
-import _ "github.com/go-sql-driver/mysql"
 
-// Initialize a global database object
-var db *sql.DB
-var SessionID int64
-var records chan *VarDict
-var wg sync.WaitGroup
-
-func init() {
-	InitializeConfig()
-
-	var err error
-	db, err = sql.Open("mysql", Config.DBPath)
+// This function should be called before exiting the application, both normal exit and killing
+func Finish() {
+	Stop(context.Background())
+}
 
-	if err != nil {
-		fmt.Println("Fail to initialize database, exit now...", err)
-		os.Exit(1)
+func (r *Recorder) worker() {
+	defer r.wg.Done()
+	// The task of this worker is to take records from the queue and write them to the sink in batches
+	for item := range r.records {
+		if r.dropCut(item) {
+			continue
+		}
+		batch := []Record{item.record}
+		// Gather more records until the batch is full, the flush interval has passed or the queue is closed
+		timer := time.NewTimer(r.config.FlushInterval)
+	gather:
+		for len(batch) < r.config.BatchSize {
+			select {
+			case item, ok := <-r.records:
+				if !ok {
+					break gather
+				}
+				if !r.dropCut(item) {
+					batch = append(batch, item.record)
+				}
+			case <-timer.C:
+				break gather
+			}
+		}
+		timer.Stop()
+		logDebug("Writing records", "records", len(batch))
+		r.save(batch)
+		r.pending.add(-len(batch))
 	}
+}
 
-	// If it is the first time, create the tables
-	createSessionStmt := "create table if not exists Session (id INT AUTO_INCREMENT PRIMARY KEY , timestamp INTEGER, hostname TEXT, path TEXT)"
-	createRecordsStmt := "create table if not exists Record (id INT AUTO_INCREMENT PRIMARY KEY, sessionID INTEGER REFERENCES Session (id), timestamp INTEGER, name TEXT, data TEXT)"
-	ExecuteSQL(createSessionStmt)
-	ExecuteSQL(createRecordsStmt)
-
-	// Get the execution environment, including hostname, path and timestamp
-	hostname, err1 := os.Hostname()
-	cwd, err2 := os.Getwd()
-	if err1 != nil || err2 != nil {
-		fmt.Println("Fail to get environment information:", err1, err2)
+// Write a batch to the sink, or to the spool when the sink fails or records already wait there
+func (r *Recorder) save(batch []Record) {
+	if !r.spooler.busy() {
+		start := time.Now()
+		err := r.sink.WriteBatch(batch)
+		if err == nil {
+			r.metrics.written(len(batch), time.Since(start))
+			return
+		}
+		logWarn("Fail to save records, spooling them", "records", len(batch), "error", err)
+		r.reportError(&RecordError{Kind: ErrSink, Name: batchName(batch), Records: len(batch), Cause: err})
 	}
-	timestamp := time.Now().Unix()
-	newSessionStmt := "insert into Session (timestamp, hostname, path) values (?, ?, ?)"
-	result := ExecuteSQLWithArguments(newSessionStmt, timestamp, hostname, cwd)
-	
-	// keep record of the session id
-	SessionID, err = result.LastInsertId()
-	if err != nil {
-		fmt.Println("Fail to get session ID, exit")
-		return
+	if err := r.spooler.append(batch); err != nil {
+		logError("Fail to spool records, they are lost", "records", len(batch), "error", err)
+		r.reportError(&RecordError{Kind: ErrSink, Name: batchName(batch), Records: len(batch), Lost: true, Cause: err})
 	}
-
-	// Initialize the channel for VarDicts to be saved 
-	records = make(chan *VarDict, 100)
-	// Start the worker to listen on the channel
-	wg.Add(1)
-	// Currently only one worker, could support a configurable number of workers
-	go Worker()
-	// Finish() should be called when exiting abnormally
-	go func(){
-		signalChan := make(chan os.Signal, 1)
-		signal.Notify(signalChan, syscall.SIGHUP, syscall.SIGINT,syscall.SIGTERM)
-		<-signalChan
-		Finish()
-		fmt.Println("Clearing up before exit...")
-		os.Exit(1)
-	}()
 }
 
-// This function should be called before exiting the application, both normal exit and killing
-func Finish() {
-	// close the channel
-	close(records)
-	// Wait for the goroutine to finish
-	wg.Wait()
-	// Close the database
-	db.Close()
-}
-
-func Worker() {
-	if db == nil || SessionID == 0 {
-		return
+// The name of the variable of a batch, empty if it holds several
+func batchName(batch []Record) string {
+	for _, record := range batch {
+		if record.Name != batch[0].Name {
+			return ""
+		}
 	}
-	defer wg.Done()
-	// The task of this worker is to take VarDicts from the queue and put them into database
-	stmt := "insert into Record (sessionID, timestamp, name, data) values (?, ?, ?, ?)"
-	for record := range records {
-		timestamp := time.Now().Unix()
+	return batch[0].Name
+}
 
-		fmt.Println("In worker")
-		varname := (*record)["name"]
-		data := record.Dump()
-		// save to database
-		ExecuteSQLWithArguments(stmt, SessionID, timestamp, varname, data)
+func (r *Recorder) newRecord(vardict *VarDict, origin recordOrigin) (Record, error) {
+	record := Record{
+		SessionID: r.session.ID,
+		Timestamp:     origin.captured.Unix(),
+		TimestampNano: origin.captured.UnixNano(),
+		Offset:        int64(origin.captured.Sub(r.start)),
+		Sequence:      origin.sequence,
+		Caller:        origin.caller,
+		StackID:       origin.stackID,
+		Stack:         origin.stack,
 	}
+	record.Name, _ = (*vardict)["name"].(string)
+	var err error
+	record.Data, err = vardict.Encode()
+	return record, err
 }
 
-func PostRecord(vardict *VarDict){
-	// Just put it into work queue
-	select {
-	case records <- vardict:
-		// Successfully sent to worker
-		fmt.Println("Saving record to db")
-	case <-time.After(time.Millisecond*100):
-		fmt.Println("Fail to send variable value to worker")
+func PostRecord(vardict *VarDict) error {
+	r := getDefaultRecorder()
+	if r == nil {
+		return ErrNotStarted
 	}
+	name, _ := (*vardict)["name"].(string)
+	origin := r.originOf(name, 1, false)
+	r.stamp(&origin)
+	return r.postRecord(vardict, origin)
 }
 
-func ExecuteSQL(sql string) sql.Result{
-	if db == nil {
-		return nil
-	}
-	result, err := db.Exec(sql)
-	if err != nil {
-		fmt.Println("Fail to execute SQL:", sql, err)
-	}
-	return result
+// PostRecord queues a VarDict for the workers; when the queue is full,
+// the Backpressure policy of the configuration applies.
+// The errors are *RecordError of kind ErrEncode or ErrQueueFull, or ErrClosed
+func (r *Recorder) PostRecord(vardict *VarDict) error {
+	name, _ := (*vardict)["name"].(string)
+	origin := r.originOf(name, 1, false)
+	r.stamp(&origin)
+	return r.postRecord(vardict, origin)
 }
 
-func ExecuteSQLWithArguments(sqlfmt string, args ...interface{}) sql.Result{
-	if db == nil {
-		return nil
+func (r *Recorder) postRecord(vardict *VarDict, origin recordOrigin) error {
+	r.closeLock.RLock()
+	defer r.closeLock.RUnlock()
+	if r.closed {
+		return ErrClosed
+	}
+	name, _ := (*vardict)["name"].(string)
+	item := queuedRecord{gap: r.drops.takeGap(name), based: origin.based}
+	if item.gap > 0 {
+		vardict.SetField("dropped", item.gap)
 	}
-	result, err := db.Exec(sqlfmt, args...)
+	var err error
+	item.record, err = r.newRecord(vardict, origin)
+	r.pending.add(1)
 	if err != nil {
-		fmt.Println("Fail to execute SQL:", sqlfmt, err)
+		// Lost like a dropped record, the next value of the variable is recorded in full
+		item.record.Name = name
+		r.dropped(item)
+		recordErr := &RecordError{Kind: ErrEncode, Name: name, Records: 1, Lost: true, Cause: err}
+		r.metrics.failed(recordErr)
+		return recordErr
+	}
+	r.metrics.dumped(name, len(item.record.Data))
+	err = r.enqueue(item)
+	if recordErr, ok := err.(*RecordError); ok {
+		r.metrics.failed(recordErr)
 	}
-	return result
+	return err
 }
@@ -1,66 +1,124 @@
 package goclear
 
+import "context"
+import "strings"
 import "testing"
-import "time"
-import "fmt"
+
+// Start the default recorder on a memory sink, stopped with the test
+func startTestRecorder(t *testing.T) *MemorySink {
+	sink := NewMemorySink()
+	if _, err := Start(Configuration{MaxDepth: 5, Sink: sink, SpoolDir: t.TempDir()}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { Stop(context.Background()) })
+	return sink
+}
 
 func TestWorker(t *testing.T) {
+	sink := startTestRecorder(t)
+	sessionID := getDefaultRecorder().SessionID()
+
 	i1 := 4
 	vd1 := GetVarDict("i", i1)
-
-	PostRecord(&vd1)
-
 	s := "This is a string"
 	p1 := &s
 	vd2 := GetVarDict("s", s)
 	vd3 := GetVarDict("p", p1)
-	PostRecord(&vd2)
-	PostRecord(&vd3)
 
-	a:= make([]int, 4)
+	a := make([]int, 4)
 	a[1] = 1
 	a[2] = 1
 	a[3] = 2
 	vd4 := GetVarDict("a", a)
-	PostRecord(&vd4)
 
 	m := make(map[string]int)
-	m["abc"]=1
-	m["def"]=2
+	m["abc"] = 1
+	m["def"] = 2
 	vd5 := GetVarDict("map", m)
-	PostRecord(&vd5)
 
-	type S struct{
-		A string
-		B int
+	type S struct {
+		A       string
+		B       int
 		Pointer *S
 	}
-
 	ss := S{"sdf", 123, nil}
 	ss.Pointer = &ss
-	vd6:= GetVarDict("struct", ss)
-	PostRecord(&vd6)
-	
-	fmt.Println("Sleep for 10 seconds, press ctrl-C to kill, Finish should be called")
-	time.Sleep(time.Second*10)
+	vd6 := GetVarDict("struct", ss)
 
+	for _, vardict := range []*VarDict{&vd1, &vd2, &vd3, &vd4, &vd5, &vd6} {
+		if err := PostRecord(vardict); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Finish saves the posted records before closing the session
 	Finish()
+	if PostRecord(&vd1) != ErrNotStarted {
+		t.Error("expected PostRecord to fail after Finish")
+	}
+
+	records, _ := sink.Records(sessionID, 0, 10)
+	names := make([]string, 0)
+	for _, record := range records {
+		names = append(names, record.Name)
+		if _, err := ParseVarDict(record.Data); err != nil {
+			t.Errorf("%s: %v", record.Name, err)
+		}
+	}
+	if strings.Join(names, " ") != "i s p a map struct" {
+		t.Fatalf("expected the records in the order they were posted, got %v", names)
+	}
+	for i, want := range []string{"4", "This is a string", "This is a string", "2", "def", "sdf"} {
+		if !strings.Contains(records[i].Data, want) {
+			t.Errorf("%s: expected %q in %s", records[i].Name, want, records[i].Data)
+		}
+	}
+	sessions, _ := sink.Sessions()
+	if sessions[0].Metadata.EndTimestamp == 0 {
+		t.Error("expected Finish to close the session")
+	}
 }
 
-func TestDumpVar(t *testing.T){
-        m := make(map[string]int)
-        m["abc"]=1
-        m["ds"]=2
-        DumpVar("m", m)
+func TestDumpVar(t *testing.T) {
+	sink := startTestRecorder(t)
+	sessionID := getDefaultRecorder().SessionID()
 
-        m["abc"] = 3 
-        m["dss"] = 4 
-        DumpVar("m", m)
+	m := make(map[string]int)
+	m["abc"] = 1
+	m["ds"] = 2
+	DumpVar("m", m)
 
-        m["abc"] = 1 
-        delete(m, "dss")
-        DumpVar("m", m)  
+	m["abc"] = 3
+	m["dss"] = 4
+	DumpVar("m", m)
 
-	Finish()
-}
+	m["abc"] = 1
+	delete(m, "dss")
+	DumpVar("m", m)
+	DumpVar("m", m)
 
+	if err := Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	records, _ := sink.Records(sessionID, 0, 10)
+	if len(records) != 4 {
+		t.Fatalf("expected 4 records, got %d", len(records))
+	}
+	for i, record := range records {
+		if record.Name != "m" || record.Sequence != int64(i+1) {
+			t.Errorf("unexpected record %d: %+v", i, record)
+		}
+	}
+	if !strings.Contains(records[0].Data, "ds") || !strings.Contains(records[1].Data, "dss") {
+		t.Errorf("expected the keys in the records: %s %s", records[0].Data, records[1].Data)
+	}
+	// The last dump repeats the one before it
+	for i, unchanged := range []bool{false, false, false, true} {
+		vardict, err := ParseVarDict(records[i].Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (vardict["metatype"] == "unchanged") != unchanged {
+			t.Errorf("record %d: expected unchanged %v, got %v", i, unchanged, vardict)
+		}
+	}
+}